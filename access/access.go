@@ -1,36 +1,29 @@
 package access
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/boltdb/bolt"
 	core "github.com/jtremback/usc-core/peer"
-	"github.com/tv42/compound"
+	"github.com/jtremback/usc-peer/errs"
 )
 
-// compound index types
-type ssb struct {
-	A string
-	B string
-	C []byte
+func MakeBuckets(db *bolt.DB) error {
+	err := db.Update(makeBuckets)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func MakeBuckets(db *bolt.DB) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("Indexes"))
-		_, err = tx.CreateBucketIfNotExists([]byte("Channels"))
-		_, err = tx.CreateBucketIfNotExists([]byte("Judges"))
-		_, err = tx.CreateBucketIfNotExists([]byte("Accounts"))
-		_, err = tx.CreateBucketIfNotExists([]byte("Counterparties"))
+func makeBuckets(tx *bolt.Tx) error {
+	for _, name := range []string{"Indexes", "Channels", "Judges", "Accounts", "Counterparties", "Outbox", "History", "HistoryEvents", "Signing", "Meta", "Keys", "Evidence"} {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
 		if err != nil {
 			return err
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 	return nil
 }
@@ -50,20 +43,23 @@ func SetJudge(tx *bolt.Tx, jd *core.Judge) error {
 }
 
 func GetJudge(tx *bolt.Tx, key []byte) (*core.Judge, error) {
+	b := tx.Bucket([]byte("Judges")).Get(key)
+	if b == nil {
+		return nil, errs.New(errs.NotFound, "judge not found")
+	}
 	jd := &core.Judge{}
-	err := json.Unmarshal(tx.Bucket([]byte("Accounts")).Get(key), jd)
+	err := json.Unmarshal(b, jd)
 	if err != nil {
 		return nil, errors.New("database error")
 	}
-	if jd == nil {
-		return nil, errors.New("judge not found")
-	}
 
 	return jd, nil
 }
 
+// SetAccount saves the account without its private key, which must be saved
+// with SetEncryptedKey.
 func SetAccount(tx *bolt.Tx, acct *core.Account) error {
-	b, err := json.Marshal(acct)
+	b, err := json.Marshal(withoutPrivkey(acct))
 	if err != nil {
 		return err
 	}
@@ -89,24 +85,51 @@ func SetAccount(tx *bolt.Tx, acct *core.Account) error {
 }
 
 func GetAccount(tx *bolt.Tx, key []byte) (*core.Account, error) {
+	b := tx.Bucket([]byte("Accounts")).Get(key)
+	if b == nil {
+		return nil, errs.New(errs.NotFound, "account not found")
+	}
 	acct := &core.Account{}
-	err := json.Unmarshal(tx.Bucket([]byte("Accounts")).Get(key), acct)
+	err := json.Unmarshal(b, acct)
 	if err != nil {
 		return nil, errors.New("database error")
 	}
-	if acct == nil {
-		return nil, errors.New("account not found")
-	}
 	err = PopulateAccount(tx, acct)
 	if err != nil {
-		return nil, errors.New("database error")
+		return nil, err
 	}
 	return acct, nil
 }
 
+func GetAccounts(tx *bolt.Tx) ([]*core.Account, error) {
+	var err error
+	accts := []*core.Account{}
+	err = tx.Bucket([]byte("Accounts")).ForEach(func(k, v []byte) error {
+		acct := &core.Account{}
+		err = json.Unmarshal(v, acct)
+		if err != nil {
+			return errors.New("database error")
+		}
+		err = PopulateAccount(tx, acct)
+		if err != nil {
+			return err
+		}
+		accts = append(accts, acct)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return accts, nil
+}
+
 func PopulateAccount(tx *bolt.Tx, acct *core.Account) error {
+	b := tx.Bucket([]byte("Judges")).Get([]byte(acct.Judge.Pubkey))
+	if b == nil {
+		return fmt.Errorf("missing judge %x", acct.Judge.Pubkey)
+	}
 	jd := &core.Judge{}
-	err := json.Unmarshal(tx.Bucket([]byte("Judges")).Get([]byte(acct.Judge.Pubkey)), jd)
+	err := json.Unmarshal(b, jd)
 	if err != nil {
 		return err
 	}
@@ -142,24 +165,29 @@ func SetCounterparty(tx *bolt.Tx, cpt *core.Counterparty) error {
 }
 
 func GetCounterparty(tx *bolt.Tx, key []byte) (*core.Counterparty, error) {
+	b := tx.Bucket([]byte("Counterparties")).Get(key)
+	if b == nil {
+		return nil, errs.New(errs.NotFound, "counterparty not found")
+	}
 	cpt := &core.Counterparty{}
-	err := json.Unmarshal(tx.Bucket([]byte("Counterparties")).Get(key), cpt)
+	err := json.Unmarshal(b, cpt)
 	if err != nil {
 		return nil, errors.New("database error")
 	}
-	if cpt == nil {
-		return nil, errors.New("account not found")
-	}
 	err = PopulateCounterparty(tx, cpt)
 	if err != nil {
-		return nil, errors.New("database error")
+		return nil, err
 	}
 	return cpt, nil
 }
 
 func PopulateCounterparty(tx *bolt.Tx, cpt *core.Counterparty) error {
+	b := tx.Bucket([]byte("Judges")).Get([]byte(cpt.Judge.Pubkey))
+	if b == nil {
+		return fmt.Errorf("missing judge %x", cpt.Judge.Pubkey)
+	}
 	jd := &core.Judge{}
-	err := json.Unmarshal(tx.Bucket([]byte("Judges")).Get([]byte(cpt.Judge.Pubkey)), jd)
+	err := json.Unmarshal(b, jd)
 	if err != nil {
 		return err
 	}
@@ -169,7 +197,23 @@ func PopulateCounterparty(tx *bolt.Tx, cpt *core.Counterparty) error {
 	return nil
 }
 
+// SetChannel saves the channel without its account's private key.
 func SetChannel(tx *bolt.Tx, ch *core.Channel) error {
+	ch = channelWithoutPrivkey(ch)
+
+	// Drop the index entries of the version we are replacing
+	old := tx.Bucket([]byte("Channels")).Get([]byte(ch.ChannelId))
+	if old != nil {
+		oldCh := &core.Channel{}
+		err := json.Unmarshal(old, oldCh)
+		if err == nil {
+			err = deleteIndexes(tx, oldCh)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	b, err := json.Marshal(ch)
 	if err != nil {
 		return err
@@ -210,12 +254,7 @@ func SetChannel(tx *bolt.Tx, ch *core.Channel) error {
 
 	// Indexes
 
-	// Escrow Provider Pubkey
-
-	err = tx.Bucket([]byte("Indexes")).Put(compound.Key(ssb{
-		"Judge",
-		"Pubkey",
-		ch.Judge.Pubkey}), []byte(ch.ChannelId))
+	err = putIndexes(tx, ch)
 	if err != nil {
 		return err
 	}
@@ -224,68 +263,51 @@ func SetChannel(tx *bolt.Tx, ch *core.Channel) error {
 }
 
 func GetChannel(tx *bolt.Tx, key string) (*core.Channel, error) {
+	b := tx.Bucket([]byte("Channels")).Get([]byte(key))
+	if b == nil {
+		return nil, errs.New(errs.NotFound, "channel not found")
+	}
 	ch := &core.Channel{}
-	err := json.Unmarshal(tx.Bucket([]byte("Channels")).Get([]byte(key)), ch)
+	err := json.Unmarshal(b, ch)
 	if err != nil {
 		return nil, errors.New("database error")
 	}
-	if ch == nil {
-		return nil, errors.New("channel not found")
-	}
 	err = PopulateChannel(tx, ch)
 	if err != nil {
-		return nil, errors.New("database error")
+		return nil, err
 	}
 	return ch, nil
 }
 
-func GetProposedChannels(tx *bolt.Tx) ([]*core.Channel, error) {
+func GetChannels(tx *bolt.Tx) ([]*core.Channel, error) {
 	var err error
 	chs := []*core.Channel{}
-	i := 0
 	err = tx.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
 		ch := &core.Channel{}
 		err = json.Unmarshal(v, ch)
 		if err != nil {
-			return err
+			return errors.New("database error")
 		}
-		if ch.Phase == core.PENDING_OPEN && len(ch.OpeningTxEnvelope.Signatures) == 1 {
-			chs[i] = ch
-			i++
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, errors.New("database error")
-	}
-	return chs, nil
-}
-
-func GetProposedUpdateTxs(tx *bolt.Tx) ([]*core.Channel, error) {
-	var err error
-	chs := []*core.Channel{}
-	i := 0
-	err = tx.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
-		ch := &core.Channel{}
-		err = json.Unmarshal(v, ch)
+		err = PopulateChannel(tx, ch)
 		if err != nil {
 			return err
 		}
-		if bytes.Compare(ch.ProposedUpdateTxEnvelope.Signatures[ch.Me], []byte{}) == 0 {
-			chs[i] = ch
-			i++
-		}
+		chs = append(chs, ch)
 		return nil
 	})
 	if err != nil {
-		return nil, errors.New("database error")
+		return nil, err
 	}
 	return chs, nil
 }
 
 func PopulateChannel(tx *bolt.Tx, ch *core.Channel) error {
+	b := tx.Bucket([]byte("Accounts")).Get([]byte(ch.Account.Pubkey))
+	if b == nil {
+		return fmt.Errorf("missing account %x", ch.Account.Pubkey)
+	}
 	acct := &core.Account{}
-	err := json.Unmarshal(tx.Bucket([]byte("Accounts")).Get([]byte(ch.Account.Pubkey)), acct)
+	err := json.Unmarshal(b, acct)
 	if err != nil {
 		return err
 	}
@@ -294,8 +316,12 @@ func PopulateChannel(tx *bolt.Tx, ch *core.Channel) error {
 		return err
 	}
 
+	b = tx.Bucket([]byte("Counterparties")).Get([]byte(ch.Counterparty.Pubkey))
+	if b == nil {
+		return fmt.Errorf("missing counterparty %x", ch.Counterparty.Pubkey)
+	}
 	cpt := &core.Counterparty{}
-	err = json.Unmarshal(tx.Bucket([]byte("Counterparties")).Get([]byte(ch.Counterparty.Pubkey)), cpt)
+	err = json.Unmarshal(b, cpt)
 	if err != nil {
 		return err
 	}
@@ -304,8 +330,12 @@ func PopulateChannel(tx *bolt.Tx, ch *core.Channel) error {
 		return err
 	}
 
+	b = tx.Bucket([]byte("Judges")).Get([]byte(ch.Judge.Pubkey))
+	if b == nil {
+		return fmt.Errorf("missing judge %x", ch.Judge.Pubkey)
+	}
 	jd := &core.Judge{}
-	err = json.Unmarshal(tx.Bucket([]byte("Judges")).Get([]byte(ch.Judge.Pubkey)), jd)
+	err = json.Unmarshal(b, jd)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package access
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -89,7 +90,7 @@ func TestSetMyAccount(t *testing.T) {
 	db.View(func(tx *bolt.Tx) error {
 		acct2 := &core.Account{}
 		json.Unmarshal(tx.Bucket([]byte("Accounts")).Get(acct.Pubkey), acct2)
-		if !reflect.DeepEqual(acct, acct2) {
+		if !reflect.DeepEqual(withoutPrivkey(acct), acct2) {
 			t.Fatal("MyAccount incorrect")
 		}
 
@@ -335,7 +336,7 @@ func TestSetChannel(t *testing.T) {
 	db.View(func(tx *bolt.Tx) error {
 		ch2 := &core.Channel{}
 		json.Unmarshal(tx.Bucket([]byte("Channels")).Get([]byte(ch.ChannelId)), ch2)
-		if !reflect.DeepEqual(ch, ch2) {
+		if !reflect.DeepEqual(channelWithoutPrivkey(ch), ch2) {
 			t.Fatal("Channel incorrect")
 		}
 		juJson := tx.Bucket([]byte("Judges")).Get(ch.Judge.Pubkey)
@@ -350,7 +351,7 @@ func TestSetChannel(t *testing.T) {
 		acct := &core.Account{}
 		json.Unmarshal(maJson, acct)
 
-		if !reflect.DeepEqual(ch.Account, acct) {
+		if !reflect.DeepEqual(withoutPrivkey(ch.Account), acct) {
 			t.Fatal("MyAccount incorrect")
 		}
 
@@ -485,7 +486,7 @@ func TestPopulateChannel(t *testing.T) {
 			t.Fatal("Judge incorrect", ch.Judge, jd)
 		}
 
-		if !reflect.DeepEqual(ch.Account, acct) {
+		if !reflect.DeepEqual(ch.Account, withoutPrivkey(acct)) {
 			t.Fatal("MyAccount incorrect", ch.Account, acct)
 		}
 
@@ -496,3 +497,243 @@ func TestPopulateChannel(t *testing.T) {
 		return nil
 	})
 }
+
+func TestGetChannels(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  []byte{40, 40, 40},
+		Address: "stoops.com:3004",
+	}
+
+	for _, id := range []string{"abc", "xyz23"} {
+		ch := &core.Channel{
+			ChannelId: id,
+			Phase:     2,
+			Judge:     jd,
+			Account: &core.Account{
+				Name:   "crow",
+				Pubkey: []byte{50, 50, 50},
+				Judge:  jd,
+			},
+			Counterparty: &core.Counterparty{
+				Name:   "flerb",
+				Pubkey: []byte{60, 60, 60},
+				Judge:  jd,
+			},
+		}
+
+		db.Update(func(tx *bolt.Tx) error {
+			err := SetChannel(tx, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		})
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		chs, err := GetChannels(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chs) != 2 || chs[0].ChannelId != "abc" || chs[1].ChannelId != "xyz23" {
+			t.Fatal("Channels incorrect", chs)
+		}
+
+		if !reflect.DeepEqual(chs[1].Judge, jd) {
+			t.Fatal("Judge incorrect", chs[1].Judge, jd)
+		}
+		return nil
+	})
+}
+
+func TestGetProposed(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  []byte{40, 40, 40},
+		Address: "stoops.com:3004",
+	}
+
+	chs := []*core.Channel{
+		{
+			ChannelId:         "proposed",
+			Phase:             core.PENDING_OPEN,
+			Me:                1,
+			OpeningTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}, []byte{}}},
+		},
+		{
+			ChannelId:         "confirmed",
+			Phase:             core.PENDING_OPEN,
+			Me:                1,
+			OpeningTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}, []byte{2}}},
+		},
+		{
+			ChannelId:                "update",
+			Phase:                    core.OPEN,
+			Me:                       1,
+			OpeningTxEnvelope:        &wire.Envelope{Signatures: [][]byte{[]byte{1}, []byte{2}, []byte{3}}},
+			ProposedUpdateTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}, []byte{}}},
+		},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		for _, ch := range chs {
+			ch.Judge = jd
+			ch.Account = &core.Account{Pubkey: []byte{50, 50, 50}, Judge: jd}
+			ch.Counterparty = &core.Counterparty{Pubkey: []byte{60, 60, 60}, Judge: jd}
+			err := SetChannel(tx, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		pchs, err := GetProposedChannels(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pchs) != 1 || pchs[0].ChannelId != "proposed" {
+			t.Fatal("proposed channels incorrect", pchs)
+		}
+
+		uchs, err := GetProposedUpdateTxs(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uchs) != 1 || uchs[0].ChannelId != "update" {
+			t.Fatal("proposed update txs incorrect", uchs)
+		}
+		return nil
+	})
+}
+
+func TestIndexes(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  bytes.Repeat([]byte{40}, 32),
+		Address: "stoops.com:3004",
+	}
+	apub := bytes.Repeat([]byte{50}, 32)
+	cpub := bytes.Repeat([]byte{60}, 32)
+
+	ch := &core.Channel{
+		ChannelId:         "chan",
+		Phase:             core.PENDING_OPEN,
+		OpeningTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}, []byte{2}}},
+		Judge:             jd,
+		Account:           &core.Account{Pubkey: apub, Judge: jd},
+		Counterparty:      &core.Counterparty{Pubkey: cpub, Judge: jd},
+	}
+
+	// The counterparty's pubkey ends with the short one's, and would share a
+	// prefix with it in the index.
+	short := &core.Channel{
+		ChannelId:         "short",
+		Phase:             core.OPEN,
+		OpeningTxEnvelope: &wire.Envelope{},
+		Judge:             jd,
+		Account:           &core.Account{Pubkey: apub, Judge: jd},
+		Counterparty:      &core.Counterparty{Pubkey: cpub[:31], Judge: jd},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		err := SetChannel(tx, ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch.Phase = core.OPEN
+		err = SetChannel(tx, ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = SetChannel(tx, short)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		chs, err := GetChannelsByPhase(tx, int(core.PENDING_OPEN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 0 {
+			t.Fatal("old phase index not removed", chs)
+		}
+
+		chs, err = GetChannelsByPhase(tx, int(core.OPEN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 2 || chs[0].ChannelId != "chan" {
+			t.Fatal("phase index incorrect", chs)
+		}
+
+		chs, err = GetChannelsByAccount(tx, apub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 2 {
+			t.Fatal("account index incorrect", chs)
+		}
+
+		chs, err = GetChannelsByCounterparty(tx, cpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 1 || chs[0].ChannelId != "chan" {
+			t.Fatal("counterparty index incorrect", chs)
+		}
+
+		chs, err = GetChannelsByCounterparty(tx, cpub[:31])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 0 {
+			t.Fatal("short pubkey indexed", chs)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+)
+
+// Backup writes a consistent snapshot of the database to w. It only holds a
+// read transaction, so the node keeps running while it is taken.
+func Backup(db *bolt.DB, w io.Writer) (int64, error) {
+	var n int64
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// StaleChannel is a channel whose state in a backup may be older than the
+// state held by the counterparty.
+type StaleChannel struct {
+	ChannelId string
+	Phase     string
+	// SequenceNumber is that of the backup's LastFullUpdateTx, 0 if there is
+	// none.
+	SequenceNumber uint32
+	// Newer is true if the database being replaced holds a later state, so
+	// that restoring the backup is known to lose it.
+	Newer bool
+	Msg   string
+}
+
+// CompareStates lists the channels in backup that are not closed. Any of them
+// may have moved on since the backup was taken, and the counterparty could
+// then post a later UpdateTx than the one we hold. If current is not nil, it is
+// the database the backup would replace, and channels where it holds a later
+// state are marked Newer.
+func CompareStates(backup *bolt.Tx, current *bolt.Tx) ([]*StaleChannel, error) {
+	var err error
+	stale := []*StaleChannel{}
+	err = backup.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
+		ch := &core.Channel{}
+		err = json.Unmarshal(v, ch)
+		if err != nil {
+			return err
+		}
+		if ch.Phase == core.CLOSED {
+			return nil
+		}
+
+		s := &StaleChannel{
+			ChannelId:      ch.ChannelId,
+			Phase:          PhaseName(ch),
+			SequenceNumber: sequenceNumber(ch),
+			Msg:            "counterparty may hold a later UpdateTx",
+		}
+
+		if current != nil {
+			b := current.Bucket([]byte("Channels")).Get(k)
+			if b == nil {
+				s.Msg = "channel is not in the database being replaced, counterparty may hold a later UpdateTx"
+			} else {
+				cur := &core.Channel{}
+				err = json.Unmarshal(b, cur)
+				if err != nil {
+					return err
+				}
+				if seq := sequenceNumber(cur); seq > s.SequenceNumber {
+					s.Newer = true
+					s.Msg = fmt.Sprintf("database being replaced has sequence number %d", seq)
+				} else if phaseOrder[int(cur.Phase)] > phaseOrder[int(ch.Phase)] {
+					s.Newer = true
+					s.Msg = "database being replaced has the channel in " + PhaseName(cur)
+				}
+			}
+		}
+
+		stale = append(stale, s)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+
+	return stale, nil
+}
+
+// phaseOrder ranks the phases in the order a channel goes through them.
+var phaseOrder = map[int]int{
+	int(core.PENDING_OPEN):   0,
+	int(core.OPEN):           1,
+	int(core.PENDING_CLOSED): 2,
+	int(core.CLOSED):         3,
+}
+
+// sequenceNumber is the highest sequence number we have signed on a channel.
+func sequenceNumber(ch *core.Channel) uint32 {
+	seq := uint32(0)
+	if ch.LastFullUpdateTx != nil {
+		seq = ch.LastFullUpdateTx.SequenceNumber
+	}
+	if ch.ProposedUpdateTx != nil && signedBy(ch.ProposedUpdateTxEnvelope, ch.Me) && ch.ProposedUpdateTx.SequenceNumber > seq {
+		seq = ch.ProposedUpdateTx.SequenceNumber
+	}
+	return seq
+}
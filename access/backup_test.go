@@ -0,0 +1,102 @@
+package access
+
+import (
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestBackup(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  []byte{40, 40, 40},
+		Address: "stoops.com:3004",
+	}
+
+	setChannel := func(chID string, closed bool, seq uint32) {
+		ch := &core.Channel{
+			ChannelId:         chID,
+			OpeningTxEnvelope: &wire.Envelope{},
+			LastFullUpdateTx:  &wire.UpdateTx{ChannelId: chID, SequenceNumber: seq},
+			Judge:             jd,
+			Account:           &core.Account{Pubkey: []byte{50, 50, 50}, Judge: jd},
+			Counterparty:      &core.Counterparty{Pubkey: []byte{60, 60, 60}, Judge: jd},
+		}
+		ch.Phase = core.OPEN
+		if closed {
+			ch.Phase = core.CLOSED
+		}
+		db.Update(func(tx *bolt.Tx) error {
+			err := SetChannel(tx, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		})
+	}
+
+	setChannel("open", false, 3)
+	setChannel("moved", false, 3)
+	setChannel("closed", true, 3)
+
+	f, err := os.Create("/tmp/test_backup.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("/tmp/test_backup.db")
+
+	_, err = Backup(db, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	setChannel("moved", false, 4)
+
+	backup, err := bolt.Open("/tmp/test_backup.db", 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	backup.View(func(btx *bolt.Tx) error {
+		return db.View(func(tx *bolt.Tx) error {
+			stale, err := CompareStates(btx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stale) != 2 {
+				t.Fatal("expected the two open channels, got", stale)
+			}
+			for _, s := range stale {
+				if s.Newer != (s.ChannelId == "moved") {
+					t.Fatal("newer state not detected", s)
+				}
+			}
+
+			stale, err = CompareStates(btx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stale) != 2 || stale[0].Newer || stale[1].Newer {
+				t.Fatal("incorrect without a current database", stale)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package access
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// Compact copies every bucket of the database at path into a fresh file and
+// renames it over the original. Bolt does not clear the pages it frees, so
+// this is the only way to be sure that data which has been overwritten, such
+// as account keys that used to be stored in the clear, is gone from the file.
+// The database must not be open.
+func Compact(path string) error {
+	src, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = src.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src into dst.
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, src.Bucket(k))
+	})
+}
@@ -0,0 +1,73 @@
+package access
+
+import (
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompact(t *testing.T) {
+	path := "/tmp/test_compact.db"
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := AddOutboxMessage(tx, &OutboxMessage{ChannelId: "a"})
+		if err != nil {
+			return err
+		}
+		nested, err := tx.Bucket([]byte("Indexes")).CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		err = nested.Put([]byte("k"), []byte("v"))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("Meta")).Put([]byte("gone"), []byte("secret"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Meta")).Delete([]byte("gone"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	err = Compact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Evidence")) == nil {
+			t.Fatal("bucket not copied")
+		}
+		nested := tx.Bucket([]byte("Indexes")).Bucket([]byte("nested"))
+		if nested == nil || string(nested.Get([]byte("k"))) != "v" {
+			t.Fatal("nested bucket not copied")
+		}
+		if tx.Bucket([]byte("Outbox")).Sequence() != 1 {
+			t.Fatal("sequence not copied")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+package access
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/tv42/compound"
+)
+
+// Evidence shows that a participant signed two different UpdateTxs with the
+// same sequence number on a channel. It holds everything needed to check this
+// without access to our database: the fully signed OpeningTx ties the signer's
+// pubkey to the channel, and both UpdateTx envelopes carry the signer's
+// signature.
+type Evidence struct {
+	Id        uint64
+	ChannelId string
+	// SequenceNumber is that of both UpdateTxs.
+	SequenceNumber uint32
+	// Signer is the index of the participant in the OpeningTx who signed both
+	// UpdateTxs.
+	Signer            uint32
+	OpeningTxEnvelope *wire.Envelope
+	Envelopes         []*wire.Envelope
+	Time              time.Time
+}
+
+// Verify checks the evidence on its own. It returns nil if the evidence proves
+// that the signer equivocated.
+func (e *Evidence) Verify() error {
+	if e.OpeningTxEnvelope == nil || len(e.Envelopes) != 2 || e.Envelopes[0] == nil || e.Envelopes[1] == nil {
+		return errors.New("evidence is incomplete")
+	}
+
+	otx := &wire.OpeningTx{}
+	err := proto.Unmarshal(e.OpeningTxEnvelope.Payload, otx)
+	if err != nil {
+		return errors.New("OpeningTx does not parse")
+	}
+	if otx.ChannelId != e.ChannelId {
+		return errors.New("OpeningTx is for another channel")
+	}
+	if len(otx.Pubkeys) != 3 || e.Signer > 1 {
+		return errors.New("signer is not a participant")
+	}
+	for i, pubkey := range otx.Pubkeys {
+		if !verifies(e.OpeningTxEnvelope, uint32(i), pubkey) {
+			return fmt.Errorf("OpeningTx signature %d does not verify", i)
+		}
+	}
+
+	if bytes.Equal(e.Envelopes[0].Payload, e.Envelopes[1].Payload) {
+		return errors.New("UpdateTxs are the same")
+	}
+	for i, ev := range e.Envelopes {
+		utx := &wire.UpdateTx{}
+		err := proto.Unmarshal(ev.Payload, utx)
+		if err != nil {
+			return fmt.Errorf("UpdateTx %d does not parse", i)
+		}
+		if utx.ChannelId != e.ChannelId || utx.SequenceNumber != e.SequenceNumber {
+			return fmt.Errorf("UpdateTx %d is for another channel or sequence number", i)
+		}
+		if !verifies(ev, e.Signer, otx.Pubkeys[e.Signer]) {
+			return fmt.Errorf("UpdateTx %d is not signed by the signer", i)
+		}
+	}
+
+	return nil
+}
+
+// Same checks whether two pieces of evidence are about the same pair of
+// envelopes.
+func (e *Evidence) Same(o *Evidence) bool {
+	if e.ChannelId != o.ChannelId || len(e.Envelopes) != 2 || len(o.Envelopes) != 2 {
+		return false
+	}
+	a0, a1 := e.Envelopes[0].Payload, e.Envelopes[1].Payload
+	b0, b1 := o.Envelopes[0].Payload, o.Envelopes[1].Payload
+	return (bytes.Equal(a0, b0) && bytes.Equal(a1, b1)) || (bytes.Equal(a0, b1) && bytes.Equal(a1, b0))
+}
+
+func verifies(ev *wire.Envelope, i uint32, pubkey []byte) bool {
+	return signedBy(ev, i) &&
+		len(pubkey) == ed25519.PublicKeySize &&
+		ed25519.Verify(ed25519.PublicKey(pubkey), ev.Payload, ev.Signatures[i])
+}
+
+// AddEvidence assigns the evidence an Id and saves it. If it has no Time, it
+// is set to now.
+func AddEvidence(tx *bolt.Tx, e *Evidence) error {
+	bkt := tx.Bucket([]byte("Evidence"))
+
+	id, err := bkt.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Id = id
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Keyed like history, by channel id, then sequence number, then Id.
+	return bkt.Put(compound.Key(historyKey{e.ChannelId, e.SequenceNumber, e.Id}), b)
+}
+
+// GetEvidence returns the evidence found on a channel, ordered by sequence
+// number.
+func GetEvidence(tx *bolt.Tx, chID string) ([]*Evidence, error) {
+	es := []*Evidence{}
+	prefix := compound.Key(historyPrefix{chID})
+	c := tx.Bucket([]byte("Evidence")).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		e := &Evidence{}
+		err := json.Unmarshal(v, e)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
@@ -0,0 +1,407 @@
+package access
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Bucket string
+	Key    string
+	Msg    string
+	// Repaired is true if Check fixed the problem.
+	Repaired bool
+}
+
+func (p *Problem) String() string {
+	s := fmt.Sprintf("%s/%s: %s", p.Bucket, p.Key, p.Msg)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+type checker struct {
+	tx       *bolt.Tx
+	repair   bool
+	problems []*Problem
+	missing  map[string]bool
+}
+
+func (c *checker) report(bucket string, key []byte, repaired bool, format string, args ...interface{}) {
+	k := string(key)
+	if bucket != "Channels" && bucket != "Outbox" && bucket != "Signing" && bucket != "Meta" {
+		k = fmt.Sprintf("%x", key)
+	}
+	c.problems = append(c.problems, &Problem{
+		Bucket:   bucket,
+		Key:      k,
+		Msg:      fmt.Sprintf(format, args...),
+		Repaired: repaired,
+	})
+}
+
+// Check walks every bucket looking for undecodable records, references to
+// judges, accounts or counterparties that are missing, stale or missing index
+// entries, envelopes with invalid signatures and channels whose phase does not
+// match their signatures.
+//
+// With repair, missing judges, accounts and counterparties are restored from
+// the copies embedded in the records that reference them, and the indexes are
+// fixed. Everything else is only reported.
+func Check(db *bolt.DB, repair bool) ([]*Problem, error) {
+	c := &checker{repair: repair}
+	fn := func(tx *bolt.Tx) error {
+		c.tx = tx
+		return c.check()
+	}
+
+	var err error
+	if repair {
+		err = db.Update(fn)
+	} else {
+		err = db.View(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.problems, nil
+}
+
+func (c *checker) check() error {
+	c.missing = map[string]bool{}
+	for _, name := range []string{"Indexes", "Channels", "Judges", "Accounts", "Counterparties", "Outbox", "History", "HistoryEvents", "Signing", "Meta", "Keys", "Evidence"} {
+		if c.tx.Bucket([]byte(name)) == nil {
+			c.report(name, nil, false, "bucket is missing")
+			c.missing[name] = true
+		}
+	}
+
+	if !c.missing["Meta"] && SchemaVersion(c.tx) != LatestSchemaVersion() {
+		c.report("Meta", []byte("SchemaVersion"), false, "schema version is %d, expected %d", SchemaVersion(c.tx), LatestSchemaVersion())
+	}
+
+	err := c.checkJSON("Judges", func() interface{} { return &core.Judge{} })
+	if err != nil {
+		return err
+	}
+	err = c.checkJSON("Outbox", func() interface{} { return &OutboxMessage{} })
+	if err != nil {
+		return err
+	}
+	err = c.checkJSON("History", func() interface{} { return &HistoryEntry{} })
+	if err != nil {
+		return err
+	}
+	err = c.checkJSON("Signing", func() interface{} { return &Signing{} })
+	if err != nil {
+		return err
+	}
+	err = c.checkJSON("Evidence", func() interface{} { return &Evidence{} })
+	if err != nil {
+		return err
+	}
+
+	err = c.forEach("Accounts", func(k, v []byte) error {
+		acct := &core.Account{}
+		err := json.Unmarshal(v, acct)
+		if err != nil {
+			c.report("Accounts", k, false, "undecodable: %v", err)
+			return nil
+		}
+		if len(acct.Privkey) > 0 {
+			c.report("Accounts", k, false, "private key is stored unencrypted, unlock the node to encrypt it")
+		}
+		if (c.missing["Keys"] || c.tx.Bucket([]byte("Keys")).Get(k) == nil) && len(acct.Privkey) == 0 {
+			c.report("Accounts", k, false, "has no private key")
+		}
+		return c.checkJudge("Accounts", k, acct.Judge)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.forEach("Counterparties", func(k, v []byte) error {
+		cpt := &core.Counterparty{}
+		err := json.Unmarshal(v, cpt)
+		if err != nil {
+			c.report("Counterparties", k, false, "undecodable: %v", err)
+			return nil
+		}
+		return c.checkJudge("Counterparties", k, cpt.Judge)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Collect the channels first, repairs can't be made while iterating.
+	chs := []*core.Channel{}
+	err = c.forEach("Channels", func(k, v []byte) error {
+		ch := &core.Channel{}
+		err := json.Unmarshal(v, ch)
+		if err != nil {
+			c.report("Channels", k, false, "undecodable: %v", err)
+			return nil
+		}
+		if ch.Account != nil && len(ch.Account.Privkey) > 0 {
+			c.report("Channels", k, false, "private key is stored unencrypted, unlock the node to encrypt it")
+		}
+		if ch.ChannelId != string(k) {
+			c.report("Channels", k, false, "stored under the wrong key, channel id is %s", ch.ChannelId)
+		}
+		chs = append(chs, ch)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range chs {
+		err = c.checkChannel(ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.checkIndexes(chs)
+}
+
+// forEach calls fn for each record in bucket, skipping a bucket that is
+// missing, which has already been reported.
+func (c *checker) forEach(bucket string, fn func(k, v []byte) error) error {
+	if c.missing[bucket] {
+		return nil
+	}
+	return c.tx.Bucket([]byte(bucket)).ForEach(fn)
+}
+
+func (c *checker) checkJSON(bucket string, newRecord func() interface{}) error {
+	return c.forEach(bucket, func(k, v []byte) error {
+		err := json.Unmarshal(v, newRecord())
+		if err != nil {
+			c.report(bucket, k, false, "undecodable: %v", err)
+		}
+		return nil
+	})
+}
+
+// restore checks that a referenced record exists in bucket, restoring it from
+// the embedded copy if we are repairing.
+func (c *checker) restore(bucket string, key []byte, what string, record interface{}, refBucket string, refKey []byte) error {
+	if c.missing[bucket] || c.tx.Bucket([]byte(bucket)).Get(key) != nil {
+		return nil
+	}
+
+	if !c.repair {
+		c.report(refBucket, refKey, false, "references missing %s %x", what, key)
+		return nil
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = c.tx.Bucket([]byte(bucket)).Put(key, b)
+	if err != nil {
+		return err
+	}
+
+	c.report(refBucket, refKey, true, "references missing %s %x", what, key)
+	return nil
+}
+
+func (c *checker) checkJudge(bucket string, key []byte, jd *core.Judge) error {
+	if jd == nil || len(jd.Pubkey) == 0 {
+		c.report(bucket, key, false, "has no judge")
+		return nil
+	}
+	return c.restore("Judges", jd.Pubkey, "judge", jd, bucket, key)
+}
+
+func (c *checker) checkChannel(ch *core.Channel) error {
+	key := []byte(ch.ChannelId)
+
+	if ch.Account == nil || ch.Counterparty == nil || ch.Judge == nil {
+		c.report("Channels", key, false, "is missing its account, counterparty or judge")
+		return nil
+	}
+
+	err := c.restore("Accounts", ch.Account.Pubkey, "account", ch.Account, "Channels", key)
+	if err != nil {
+		return err
+	}
+	err = c.restore("Counterparties", ch.Counterparty.Pubkey, "counterparty", ch.Counterparty, "Channels", key)
+	if err != nil {
+		return err
+	}
+	err = c.checkJudge("Channels", key, ch.Judge)
+	if err != nil {
+		return err
+	}
+
+	if ch.OpeningTx == nil || ch.OpeningTxEnvelope == nil {
+		c.report("Channels", key, false, "has no OpeningTx")
+		return nil
+	}
+
+	pubkeys := ch.OpeningTx.Pubkeys
+	if len(pubkeys) < 2 {
+		c.report("Channels", key, false, "OpeningTx has %d pubkeys", len(pubkeys))
+		return nil
+	}
+	if len(pubkeys) < 3 {
+		pubkeys = append(pubkeys, ch.Judge.Pubkey)
+	}
+	if int(ch.Me) > 1 || !bytes.Equal(pubkeys[ch.Me], ch.Account.Pubkey) || !bytes.Equal(pubkeys[1-ch.Me], ch.Counterparty.Pubkey) {
+		c.report("Channels", key, false, "OpeningTx pubkeys do not match the account and counterparty")
+	}
+
+	c.checkSignatures(key, "OpeningTx", ch.OpeningTxEnvelope, pubkeys)
+	if ch.ProposedUpdateTxEnvelope != nil {
+		c.checkSignatures(key, "ProposedUpdateTx", ch.ProposedUpdateTxEnvelope, pubkeys[:2])
+	}
+	if ch.LastFullUpdateTxEnvelope != nil {
+		c.checkSignatures(key, "LastFullUpdateTx", ch.LastFullUpdateTxEnvelope, pubkeys[:2])
+	}
+
+	c.checkPhase(ch)
+	return nil
+}
+
+// checkSignatures reports signatures that are present but do not verify.
+func (c *checker) checkSignatures(key []byte, name string, ev *wire.Envelope, pubkeys [][]byte) {
+	for i, sig := range ev.Signatures {
+		if len(sig) == 0 {
+			continue
+		}
+		if i >= len(pubkeys) {
+			c.report("Channels", key, false, "%s has an extra signature %d", name, i)
+			continue
+		}
+		if len(pubkeys[i]) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pubkeys[i]), ev.Payload, sig) {
+			c.report("Channels", key, false, "%s signature %d does not verify", name, i)
+		}
+	}
+}
+
+func (c *checker) checkPhase(ch *core.Channel) {
+	key := []byte(ch.ChannelId)
+	openingSigs := 0
+	for i := uint32(0); i < 3; i++ {
+		if signedBy(ch.OpeningTxEnvelope, i) {
+			openingSigs++
+		}
+	}
+
+	switch ch.Phase {
+	case core.PENDING_OPEN:
+		if openingSigs == 3 {
+			c.report("Channels", key, false, "is PENDING_OPEN but the OpeningTx is fully signed")
+		}
+		if ch.ProposedUpdateTxEnvelope != nil || ch.LastFullUpdateTxEnvelope != nil {
+			c.report("Channels", key, false, "is PENDING_OPEN but has an UpdateTx")
+		}
+	case core.OPEN, core.PENDING_CLOSED:
+		if openingSigs != 3 {
+			c.report("Channels", key, false, "is %s but the OpeningTx has %d of 3 signatures", PhaseName(ch), openingSigs)
+		}
+	case core.CLOSED:
+		// A proposal that was rejected is closed without being open.
+	default:
+		c.report("Channels", key, false, "has unknown phase %d", int(ch.Phase))
+	}
+
+	if ch.LastFullUpdateTxEnvelope != nil && (!signedBy(ch.LastFullUpdateTxEnvelope, 0) || !signedBy(ch.LastFullUpdateTxEnvelope, 1)) {
+		c.report("Channels", key, false, "LastFullUpdateTx is not signed by both participants")
+	}
+	if ch.ProposedUpdateTx != nil && ch.LastFullUpdateTx != nil && ch.ProposedUpdateTx.SequenceNumber <= ch.LastFullUpdateTx.SequenceNumber {
+		c.report("Channels", key, false, "ProposedUpdateTx is older than LastFullUpdateTx")
+	}
+}
+
+// checkIndexes compares the Indexes bucket with the entries the channels
+// should have.
+func (c *checker) checkIndexes(chs []*core.Channel) error {
+	if c.missing["Indexes"] {
+		return nil
+	}
+
+	want := map[string]string{}
+	for _, ch := range chs {
+		for _, ix := range indexes(ch) {
+			want[string(indexKey(ix, ch.ChannelId))] = ch.ChannelId
+		}
+	}
+
+	bkt := c.tx.Bucket([]byte("Indexes"))
+	stale := [][]byte{}
+	err := bkt.ForEach(func(k, v []byte) error {
+		chID, ok := want[string(k)]
+		if !ok || chID != string(v) {
+			stale = append(stale, append([]byte{}, k...))
+			return nil
+		}
+		delete(want, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range stale {
+		if c.repair {
+			err = bkt.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		c.report("Indexes", k, c.repair, "stale index entry")
+	}
+
+	missing := []string{}
+	for k := range want {
+		missing = append(missing, k)
+	}
+	sort.Strings(missing)
+
+	for _, k := range missing {
+		chID := want[k]
+		if c.repair {
+			err = bkt.Put([]byte(k), []byte(chID))
+			if err != nil {
+				return err
+			}
+		}
+		c.report("Indexes", []byte(k), c.repair, "missing index entry for channel %s", chID)
+	}
+
+	return nil
+}
+
+// PhaseName returns the name of the channel's phase. A channel that was closed
+// without ever being opened is ABANDONED.
+func PhaseName(ch *core.Channel) string {
+	switch ch.Phase {
+	case core.PENDING_OPEN:
+		return "PENDING_OPEN"
+	case core.OPEN:
+		return "OPEN"
+	case core.PENDING_CLOSED:
+		return "PENDING_CLOSED"
+	case core.CLOSED:
+		if !signedBy(ch.OpeningTxEnvelope, 0) || !signedBy(ch.OpeningTxEnvelope, 1) || !signedBy(ch.OpeningTxEnvelope, 2) {
+			return "ABANDONED"
+		}
+		return "CLOSED"
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,218 @@
+package access
+
+import (
+	"crypto/ed25519"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestCheck(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Migrate(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpub, mpriv, _ := ed25519.GenerateKey(nil)
+	tpub, tpriv, _ := ed25519.GenerateKey(nil)
+	jpub, jpriv, _ := ed25519.GenerateKey(nil)
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  jpub,
+		Address: "stoops.com:3004",
+	}
+
+	otx := &wire.OpeningTx{ChannelId: "good", Pubkeys: [][]byte{mpub, tpub, jpub}}
+	payload := []byte("opening tx")
+	good := &core.Channel{
+		ChannelId: "good",
+		Phase:     core.OPEN,
+		OpeningTx: otx,
+		OpeningTxEnvelope: &wire.Envelope{
+			Payload: payload,
+			Signatures: [][]byte{
+				ed25519.Sign(mpriv, payload),
+				ed25519.Sign(tpriv, payload),
+				ed25519.Sign(jpriv, payload),
+			},
+		},
+		Judge:        jd,
+		Account:      &core.Account{Pubkey: mpub, Judge: jd},
+		Counterparty: &core.Counterparty{Pubkey: tpub, Judge: jd},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		err := SetChannel(tx, good)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = SetEncryptedKey(tx, &EncryptedKey{Pubkey: mpub, Ciphertext: []byte{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+
+	problems, err := Check(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatal("problems found in a good database", problems)
+	}
+
+	// Break it
+
+	db.Update(func(tx *bolt.Tx) error {
+		bad := *good
+		bad.ChannelId = "bad"
+		bad.OpeningTxEnvelope = &wire.Envelope{
+			Payload:    payload,
+			Signatures: [][]byte{ed25519.Sign(tpriv, payload), []byte{}},
+		}
+		err := SetChannel(tx, &bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx.Bucket([]byte("Judges")).Delete(jpub)
+		tx.Bucket([]byte("Indexes")).Put([]byte("stale"), []byte("gone"))
+		tx.Bucket([]byte("Outbox")).Put([]byte("junk"), []byte("{"))
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		_, err := GetChannel(tx, "good")
+		if err == nil || !strings.Contains(err.Error(), "missing judge") {
+			t.Fatal("missing judge not reported by GetChannel", err)
+		}
+		_, err = GetChannels(tx)
+		if err == nil || !strings.Contains(err.Error(), "missing judge") {
+			t.Fatal("missing judge not reported by GetChannels", err)
+		}
+		_, err = GetAccount(tx, mpub)
+		if err == nil || !strings.Contains(err.Error(), "missing judge") {
+			t.Fatal("missing judge not reported by GetAccount", err)
+		}
+		_, err = GetCounterparty(tx, tpub)
+		if err == nil || !strings.Contains(err.Error(), "missing judge") {
+			t.Fatal("missing judge not reported by GetCounterparty", err)
+		}
+		return nil
+	})
+
+	problems, err = Check(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []string{}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Fatal("repaired without repair", p)
+		}
+		msgs = append(msgs, p.String())
+	}
+	all := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"Outbox/junk: undecodable",
+		"references missing judge",
+		"Channels/bad: OpeningTx signature 0 does not verify",
+		"Channels/bad: is OPEN but the OpeningTx has 1 of 3 signatures",
+		"stale index entry",
+	} {
+		if !strings.Contains(all, want) {
+			t.Fatal("missing problem", want, "in", all)
+		}
+	}
+
+	problems, err = Check(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired := 0
+	for _, p := range problems {
+		if p.Repaired {
+			repaired++
+		}
+	}
+	if repaired != 2 {
+		t.Fatal("expected the judge and the index to be repaired", problems)
+	}
+
+	problems, err = Check(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if strings.Contains(p.Msg, "references missing") || strings.Contains(p.Msg, "index entry") {
+			t.Fatal("not repaired", p)
+		}
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		_, err := GetChannel(tx, "good")
+		if err != nil {
+			t.Fatal("channel not readable after repair", err)
+		}
+		return nil
+	})
+}
+
+func TestCheckMissingBuckets(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte("Judges"))
+		tx.DeleteBucket([]byte("Keys"))
+		tx.Bucket([]byte("Outbox")).Put([]byte("junk"), []byte("{"))
+		return nil
+	})
+
+	problems, err := Check(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []string{}
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	all := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"Judges/: bucket is missing",
+		"Keys/: bucket is missing",
+		"Outbox/junk: undecodable",
+	} {
+		if !strings.Contains(all, want) {
+			t.Fatal("missing problem", want, "in", all)
+		}
+	}
+}
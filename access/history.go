@@ -0,0 +1,126 @@
+package access
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/tv42/compound"
+)
+
+// HistoryEntry records an envelope that was sent, received, signed or rejected
+// on a channel. Entries are never changed or deleted once added.
+type HistoryEntry struct {
+	Id        uint64
+	ChannelId string
+	// Kind is "OpeningTx", "UpdateTx" or "Fulfillment".
+	Kind string
+	// SequenceNumber is that of the UpdateTx, and 0 for other kinds.
+	SequenceNumber uint32
+	// Direction is "Sent", "Received" or "Local", for envelopes that were not
+	// exchanged with anyone.
+	Direction string
+	// Event is what happened to the envelope, e.g. "Proposed", "Signed",
+	// "Confirmed", "Posted", "Rejected", "Abandoned", "Equivocated" or
+	// "Undelivered", when the outbox gave up on sending it.
+	Event string
+	// Peer is "Counterparty" or "Judge", or empty for local entries.
+	Peer     string
+	Time     time.Time
+	Envelope *wire.Envelope
+	// Reason is the reason given for a rejection, or the last error for an
+	// undelivered envelope.
+	Reason string
+}
+
+// History entries are keyed by channel id, then sequence number, then Id, so
+// that a channel's entries are read back in order.
+type historyKey struct {
+	A string
+	B uint32
+	C uint64
+}
+
+type historyPrefix struct {
+	A string
+}
+
+// History entries with an envelope are also indexed in HistoryEvents by
+// channel id, event and the hash of the payload, so that whether something
+// happened to an envelope can be looked up without reading the history. The
+// value is the Id of the entry.
+type historyEventKey struct {
+	A string
+	B string
+	C []byte
+}
+
+func historyEvent(chID string, event string, payload []byte) []byte {
+	h := sha256.Sum256(payload)
+	return compound.Key(historyEventKey{chID, event, h[:]})
+}
+
+func putHistoryEvent(tx *bolt.Tx, e *HistoryEntry) error {
+	if e.Envelope == nil {
+		return nil
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, e.Id)
+	return tx.Bucket([]byte("HistoryEvents")).Put(historyEvent(e.ChannelId, e.Event, e.Envelope.Payload), v)
+}
+
+// AddHistoryEntry assigns the entry an Id and saves it. If the entry has no
+// Time, it is set to now.
+func AddHistoryEntry(tx *bolt.Tx, e *HistoryEntry) error {
+	bkt := tx.Bucket([]byte("History"))
+
+	id, err := bkt.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Id = id
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = bkt.Put(compound.Key(historyKey{e.ChannelId, e.SequenceNumber, e.Id}), b)
+	if err != nil {
+		return err
+	}
+
+	return putHistoryEvent(tx, e)
+}
+
+// HasHistoryEvent checks whether the channel's history has an entry for event
+// with an envelope carrying payload.
+func HasHistoryEvent(tx *bolt.Tx, chID string, event string, payload []byte) (bool, error) {
+	return tx.Bucket([]byte("HistoryEvents")).Get(historyEvent(chID, event, payload)) != nil, nil
+}
+
+// GetHistory returns the history of a channel, ordered by sequence number and
+// then by the order the entries were added.
+func GetHistory(tx *bolt.Tx, chID string) ([]*HistoryEntry, error) {
+	es := []*HistoryEntry{}
+	prefix := compound.Key(historyPrefix{chID})
+	c := tx.Bucket([]byte("History")).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		e := &HistoryEntry{}
+		err := json.Unmarshal(v, e)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
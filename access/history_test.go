@@ -0,0 +1,58 @@
+package access
+
+import (
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestHistory(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := []*HistoryEntry{
+		{ChannelId: "chan", Kind: "UpdateTx", SequenceNumber: 2, Direction: "Received", Event: "Proposed"},
+		{ChannelId: "chan", Kind: "OpeningTx", Direction: "Sent", Event: "Proposed"},
+		{ChannelId: "chan2", Kind: "OpeningTx", Direction: "Sent", Event: "Proposed"},
+		{ChannelId: "chan", Kind: "UpdateTx", SequenceNumber: 2, Direction: "Sent", Event: "Signed"},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		for _, e := range es {
+			e.Envelope = &wire.Envelope{Payload: []byte(e.Event)}
+			err := AddHistoryEntry(tx, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		h, err := GetHistory(tx, "chan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) != 3 {
+			t.Fatal("expected 3 entries, got", len(h))
+		}
+		if h[0].Kind != "OpeningTx" || h[1].Event != "Proposed" || h[2].Event != "Signed" {
+			t.Fatal("history out of order", h[0], h[1], h[2])
+		}
+		if h[0].Time.IsZero() {
+			t.Fatal("time not set")
+		}
+		return nil
+	})
+}
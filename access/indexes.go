@@ -0,0 +1,146 @@
+package access
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/tv42/compound"
+)
+
+// compound index types
+type ssb struct {
+	A string
+	B string
+	C []byte
+}
+
+// Index entries are keyed by an ssb prefix followed by the channel id, so that
+// many channels can share a value. The value of an entry is the channel id.
+type ssbs struct {
+	A string
+	B string
+	C []byte
+	D string
+}
+
+// indexes lists the index entries of a channel as the ssb prefixes they are
+// found under.
+func indexes(ch *core.Channel) []ssb {
+	ixs := []ssb{
+		{"Phase", "Phase", []byte(strconv.Itoa(int(ch.Phase)))},
+	}
+
+	// A pubkey of the wrong size is never indexed, so that it can't make an
+	// index key that overlaps with another.
+	if ch.Judge != nil && len(ch.Judge.Pubkey) == ed25519.PublicKeySize {
+		ixs = append(ixs, ssb{"Judge", "Pubkey", ch.Judge.Pubkey})
+	}
+	if ch.Account != nil && len(ch.Account.Pubkey) == ed25519.PublicKeySize {
+		ixs = append(ixs, ssb{"Account", "Pubkey", ch.Account.Pubkey})
+	}
+	if ch.Counterparty != nil && len(ch.Counterparty.Pubkey) == ed25519.PublicKeySize {
+		ixs = append(ixs, ssb{"Counterparty", "Pubkey", ch.Counterparty.Pubkey})
+	}
+
+	if ch.Phase == core.PENDING_OPEN && !signedBy(ch.OpeningTxEnvelope, ch.Me) {
+		ixs = append(ixs, ssb{"Awaiting", "Signature", []byte("OpeningTx")})
+	}
+	if ch.ProposedUpdateTxEnvelope != nil && !signedBy(ch.ProposedUpdateTxEnvelope, ch.Me) {
+		ixs = append(ixs, ssb{"Awaiting", "Signature", []byte("UpdateTx")})
+	}
+
+	return ixs
+}
+
+func indexKey(ix ssb, chID string) []byte {
+	return compound.Key(ssbs{ix.A, ix.B, ix.C, chID})
+}
+
+func putIndexes(tx *bolt.Tx, ch *core.Channel) error {
+	bkt := tx.Bucket([]byte("Indexes"))
+	for _, ix := range indexes(ch) {
+		err := bkt.Put(indexKey(ix, ch.ChannelId), []byte(ch.ChannelId))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteIndexes(tx *bolt.Tx, ch *core.Channel) error {
+	bkt := tx.Bucket([]byte("Indexes"))
+	for _, ix := range indexes(ch) {
+		err := bkt.Delete(indexKey(ix, ch.ChannelId))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getIndexed returns the channels with index entries under prefix.
+func getIndexed(tx *bolt.Tx, prefix []byte) ([]*core.Channel, error) {
+	chs := []*core.Channel{}
+	c := tx.Bucket([]byte("Indexes")).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		ch, err := GetChannel(tx, string(v))
+		if err != nil {
+			return nil, err
+		}
+		chs = append(chs, ch)
+	}
+	return chs, nil
+}
+
+// GetChannelsByPhase returns the channels in a phase, e.g. int(core.OPEN).
+func GetChannelsByPhase(tx *bolt.Tx, phase int) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Phase", "Phase", []byte(strconv.Itoa(phase))}))
+}
+
+func GetChannelsByJudge(tx *bolt.Tx, pubkey []byte) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Judge", "Pubkey", pubkey}))
+}
+
+func GetChannelsByAccount(tx *bolt.Tx, pubkey []byte) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Account", "Pubkey", pubkey}))
+}
+
+func GetChannelsByCounterparty(tx *bolt.Tx, pubkey []byte) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Counterparty", "Pubkey", pubkey}))
+}
+
+// GetChannelsAwaitingSignature returns channels with an OpeningTx or a
+// ProposedUpdateTx that is waiting for our signature.
+func GetChannelsAwaitingSignature(tx *bolt.Tx) ([]*core.Channel, error) {
+	chs, err := GetProposedChannels(tx)
+	if err != nil {
+		return nil, err
+	}
+	uchs, err := GetProposedUpdateTxs(tx)
+	if err != nil {
+		return nil, err
+	}
+	return append(chs, uchs...), nil
+}
+
+// GetProposedChannels returns channels whose OpeningTx is waiting for our
+// signature.
+func GetProposedChannels(tx *bolt.Tx) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Awaiting", "Signature", []byte("OpeningTx")}))
+}
+
+// GetProposedUpdateTxs returns channels with a ProposedUpdateTx that is
+// waiting for our signature.
+func GetProposedUpdateTxs(tx *bolt.Tx) ([]*core.Channel, error) {
+	return getIndexed(tx, compound.Key(ssb{"Awaiting", "Signature", []byte("UpdateTx")}))
+}
+
+// signedBy checks whether the envelope has a signature at index i. Missing
+// signatures may be left as empty slots.
+func signedBy(ev *wire.Envelope, i uint32) bool {
+	return ev != nil && int(i) < len(ev.Signatures) && len(ev.Signatures[i]) > 0
+}
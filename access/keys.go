@@ -0,0 +1,206 @@
+package access
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/errs"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Account private keys are never stored in the clear. They are sealed with
+// AES-GCM under a key derived from the node's passphrase with scrypt, and kept
+// in the Keys bucket. Accounts and channels are stored without them.
+
+// KeyParams is how the passphrase is turned into the key that account keys
+// are sealed with. There is one set of params per database.
+type KeyParams struct {
+	Salt []byte
+	N    int
+	R    int
+	P    int
+	// Check is a known value sealed with the derived key, used to tell a wrong
+	// passphrase apart before any account key is touched.
+	Check []byte
+}
+
+// EncryptedKey is an account's private key, sealed with the key derived from
+// KeyParams.
+type EncryptedKey struct {
+	Pubkey     []byte
+	Ciphertext []byte
+}
+
+var keyCheck = []byte("usc-peer key check")
+
+// NewKeyParams generates a salt for a passphrase and returns the params along
+// with the derived key. Deriving a key is slow on purpose, so neither this nor
+// DeriveKey should be called inside a transaction.
+func NewKeyParams(passphrase []byte) (*KeyParams, []byte, error) {
+	p := &KeyParams{
+		Salt: make([]byte, 32),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+	_, err := rand.Read(p.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := scrypt.Key(passphrase, p.Salt, p.N, p.R, p.P, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.Check, err = seal(key, keyCheck, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p, key, nil
+}
+
+// DeriveKey returns the key for a passphrase, or a WrongPassphrase error.
+func (p *KeyParams) DeriveKey(passphrase []byte) ([]byte, error) {
+	key, err := scrypt.Key(passphrase, p.Salt, p.N, p.R, p.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = open(key, p.Check, nil)
+	if err != nil {
+		return nil, errs.New(errs.WrongPassphrase, "wrong passphrase")
+	}
+
+	return key, nil
+}
+
+// SealKey encrypts an account's private key.
+func SealKey(key []byte, pubkey []byte, privkey []byte) (*EncryptedKey, error) {
+	ct, err := seal(key, privkey, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedKey{Pubkey: pubkey, Ciphertext: ct}, nil
+}
+
+// Open decrypts the private key.
+func (k *EncryptedKey) Open(key []byte) ([]byte, error) {
+	priv, err := open(key, k.Ciphertext, k.Pubkey)
+	if err != nil {
+		return nil, errs.New(errs.WrongPassphrase, "account key does not decrypt")
+	}
+	return priv, nil
+}
+
+// seal encrypts with AES-GCM, prefixing the nonce. The pubkey is
+// authenticated with the private key, so sealed keys can't be swapped between
+// accounts.
+func seal(key []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(key []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], ad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// withoutPrivkey returns a copy of the account that is safe to store.
+func withoutPrivkey(acct *core.Account) *core.Account {
+	if acct == nil || acct.Privkey == nil {
+		return acct
+	}
+	c := *acct
+	c.Privkey = nil
+	return &c
+}
+
+func channelWithoutPrivkey(ch *core.Channel) *core.Channel {
+	if ch.Account == nil || ch.Account.Privkey == nil {
+		return ch
+	}
+	c := *ch
+	c.Account = withoutPrivkey(ch.Account)
+	return &c
+}
+
+func SetKeyParams(tx *bolt.Tx, p *KeyParams) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("Meta")).Put([]byte("KeyParams"), b)
+}
+
+// GetKeyParams returns nil if no passphrase has been set.
+func GetKeyParams(tx *bolt.Tx) (*KeyParams, error) {
+	b := tx.Bucket([]byte("Meta")).Get([]byte("KeyParams"))
+	if b == nil {
+		return nil, nil
+	}
+	p := &KeyParams{}
+	err := json.Unmarshal(b, p)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return p, nil
+}
+
+func SetEncryptedKey(tx *bolt.Tx, k *EncryptedKey) error {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("Keys")).Put(k.Pubkey, b)
+}
+
+func GetEncryptedKeys(tx *bolt.Tx) ([]*EncryptedKey, error) {
+	var err error
+	ks := []*EncryptedKey{}
+	err = tx.Bucket([]byte("Keys")).ForEach(func(k, v []byte) error {
+		ek := &EncryptedKey{}
+		err = json.Unmarshal(v, ek)
+		if err != nil {
+			return err
+		}
+		ks = append(ks, ek)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return ks, nil
+}
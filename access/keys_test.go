@@ -0,0 +1,123 @@
+package access
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestSealKey(t *testing.T) {
+	params, key, err := NewKeyParams([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = params.DeriveKey([]byte("hunter3"))
+	if errs.CodeOf(err) != errs.WrongPassphrase {
+		t.Fatal("expected wrong passphrase, got", err)
+	}
+
+	key2, err := params.DeriveKey([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Fatal("derived key differs")
+	}
+
+	ek, err := SealKey(key, []byte{40, 40, 40}, []byte{30, 30, 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ek.Ciphertext, []byte{30, 30, 30}) {
+		t.Fatal("key not encrypted")
+	}
+
+	priv, err := ek.Open(key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(priv, []byte{30, 30, 30}) {
+		t.Fatal("wrong key opened", priv)
+	}
+
+	ek.Pubkey = []byte{41, 41, 41}
+	_, err = ek.Open(key2)
+	if err == nil {
+		t.Fatal("sealed key opened for another account")
+	}
+}
+
+func TestSetAccountWithoutPrivkey(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{Name: "joe", Pubkey: []byte{10, 10, 10}}
+	acct := &core.Account{
+		Name:    "boogie",
+		Privkey: []byte{30, 30, 30},
+		Pubkey:  []byte{40, 40, 40},
+		Judge:   jd,
+	}
+	ch := &core.Channel{
+		ChannelId:         "chan",
+		Phase:             core.PENDING_OPEN,
+		Me:                1,
+		OpeningTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}}},
+		Judge:             jd,
+		Account:           acct,
+		Counterparty:      &core.Counterparty{Name: "them", Pubkey: []byte{50, 50, 50}, Judge: jd},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		err := SetAccount(tx, acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = SetChannel(tx, ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+
+	if acct.Privkey == nil {
+		t.Fatal("caller's account was changed")
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"Accounts", "Channels"} {
+			tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+				if bytes.Contains(v, []byte(`"Privkey":"Hh4e"`)) {
+					t.Fatal("private key stored in", bucket, string(v))
+				}
+				return nil
+			})
+		}
+
+		acct2, err := GetAccount(tx, acct.Pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(acct2)
+		if acct2.Privkey != nil {
+			t.Fatal("private key returned", string(b))
+		}
+		return nil
+	})
+}
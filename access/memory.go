@@ -0,0 +1,600 @@
+package access
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// Memory is a Store that keeps everything in memory, for tests and for nodes
+// that don't need to survive a restart. Records are kept as JSON, like in
+// bolt, so that they are copied going in and out.
+//
+// Only one Update runs at a time. It works on a copy of the data, which
+// replaces the data when fn returns without an error.
+type Memory struct {
+	mu    sync.RWMutex
+	state *memState
+}
+
+var _ Store = &Memory{}
+
+func NewMemory() *Memory {
+	return &Memory{
+		state: &memState{
+			judges:         map[string][]byte{},
+			accounts:       map[string][]byte{},
+			counterparties: map[string][]byte{},
+			channels:       map[string][]byte{},
+			outbox:         map[uint64][]byte{},
+			historyEvents:  map[string]bool{},
+			signing:        map[string][]byte{},
+			keys:           map[string][]byte{},
+		},
+	}
+}
+
+func (a *Memory) Update(fn func(tx Tx) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.state.clone()
+	err := fn(&memTx{s: s, writable: true, owned: map[interface{}]bool{}})
+	if err != nil {
+		return err
+	}
+
+	a.state = s
+	return nil
+}
+
+func (a *Memory) View(fn func(tx Tx) error) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return fn(&memTx{s: a.state})
+}
+
+type memState struct {
+	judges         map[string][]byte
+	accounts       map[string][]byte
+	counterparties map[string][]byte
+	channels       map[string][]byte
+
+	outbox    map[uint64][]byte
+	outboxSeq uint64
+
+	history       [][]byte
+	historySeq    uint64
+	historyEvents map[string]bool
+
+	signing map[string][]byte
+
+	evidence    [][]byte
+	evidenceSeq uint64
+
+	keyParams []byte
+	keys      map[string][]byte
+}
+
+// clone makes a new state that shares everything with s. A writable memTx
+// copies each map the first time it writes to it, so an Update only pays for
+// the maps it touches. Values are never changed in place, only replaced, so
+// they can be shared. history and evidence are only ever appended to, and a
+// state never reads past its own length, so they can be shared too.
+func (s *memState) clone() *memState {
+	c := *s
+	return &c
+}
+
+var errReadOnly = errors.New("read-only transaction")
+
+type memTx struct {
+	s        *memState
+	writable bool
+	// owned holds the maps of s that this transaction has already copied.
+	owned map[interface{}]bool
+}
+
+// own returns the map at m for writing, first replacing it with a copy if this
+// transaction has not written to it yet.
+func (a *memTx) own(m *map[string][]byte) map[string][]byte {
+	if !a.owned[m] {
+		c := make(map[string][]byte, len(*m)+1)
+		for k, v := range *m {
+			c[k] = v
+		}
+		*m = c
+		a.owned[m] = true
+	}
+	return *m
+}
+
+func (a *memTx) ownOutbox() map[uint64][]byte {
+	if !a.owned[&a.s.outbox] {
+		c := make(map[uint64][]byte, len(a.s.outbox)+1)
+		for k, v := range a.s.outbox {
+			c[k] = v
+		}
+		a.s.outbox = c
+		a.owned[&a.s.outbox] = true
+	}
+	return a.s.outbox
+}
+
+func (a *memTx) ownHistoryEvents() map[string]bool {
+	if !a.owned[&a.s.historyEvents] {
+		c := make(map[string]bool, len(a.s.historyEvents)+1)
+		for k := range a.s.historyEvents {
+			c[k] = true
+		}
+		a.s.historyEvents = c
+		a.owned[&a.s.historyEvents] = true
+	}
+	return a.s.historyEvents
+}
+
+func (a *memTx) put(m *map[string][]byte, key []byte, v interface{}) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	a.own(m)[string(key)] = b
+	return nil
+}
+
+func (a *memTx) SetJudge(jd *core.Judge) error {
+	return a.put(&a.s.judges, jd.Pubkey, jd)
+}
+
+func (a *memTx) GetJudge(key []byte) (*core.Judge, error) {
+	b, ok := a.s.judges[string(key)]
+	if !ok {
+		return nil, errs.New(errs.NotFound, "judge not found")
+	}
+	jd := &core.Judge{}
+	err := json.Unmarshal(b, jd)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return jd, nil
+}
+
+func (a *memTx) SetAccount(acct *core.Account) error {
+	err := a.put(&a.s.accounts, acct.Pubkey, withoutPrivkey(acct))
+	if err != nil {
+		return err
+	}
+	return a.put(&a.s.judges, acct.Judge.Pubkey, acct.Judge)
+}
+
+func (a *memTx) GetAccount(key []byte) (*core.Account, error) {
+	b, ok := a.s.accounts[string(key)]
+	if !ok {
+		return nil, errs.New(errs.NotFound, "account not found")
+	}
+	acct := &core.Account{}
+	err := json.Unmarshal(b, acct)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	acct.Judge, err = a.populateJudge(acct.Judge)
+	if err != nil {
+		return nil, err
+	}
+	return acct, nil
+}
+
+func (a *memTx) GetAccounts() ([]*core.Account, error) {
+	keys := []string{}
+	for k := range a.s.accounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	accts := []*core.Account{}
+	for _, k := range keys {
+		acct, err := a.GetAccount([]byte(k))
+		if err != nil {
+			return nil, err
+		}
+		accts = append(accts, acct)
+	}
+	return accts, nil
+}
+
+func (a *memTx) SetCounterparty(cpt *core.Counterparty) error {
+	err := a.put(&a.s.counterparties, cpt.Pubkey, cpt)
+	if err != nil {
+		return err
+	}
+	return a.put(&a.s.judges, cpt.Judge.Pubkey, cpt.Judge)
+}
+
+func (a *memTx) GetCounterparty(key []byte) (*core.Counterparty, error) {
+	b, ok := a.s.counterparties[string(key)]
+	if !ok {
+		return nil, errs.New(errs.NotFound, "counterparty not found")
+	}
+	cpt := &core.Counterparty{}
+	err := json.Unmarshal(b, cpt)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	cpt.Judge, err = a.populateJudge(cpt.Judge)
+	if err != nil {
+		return nil, err
+	}
+	return cpt, nil
+}
+
+func (a *memTx) populateJudge(jd *core.Judge) (*core.Judge, error) {
+	if jd == nil {
+		return nil, errors.New("missing judge")
+	}
+	b, ok := a.s.judges[string(jd.Pubkey)]
+	if !ok {
+		return nil, fmt.Errorf("missing judge %x", jd.Pubkey)
+	}
+	jd = &core.Judge{}
+	err := json.Unmarshal(b, jd)
+	if err != nil {
+		return nil, err
+	}
+	return jd, nil
+}
+
+func (a *memTx) SetChannel(ch *core.Channel) error {
+	ch = channelWithoutPrivkey(ch)
+
+	err := a.put(&a.s.channels, []byte(ch.ChannelId), ch)
+	if err != nil {
+		return err
+	}
+
+	// Relations
+
+	err = a.put(&a.s.judges, ch.Judge.Pubkey, ch.Judge)
+	if err != nil {
+		return err
+	}
+	err = a.put(&a.s.accounts, ch.Account.Pubkey, ch.Account)
+	if err != nil {
+		return err
+	}
+	return a.put(&a.s.counterparties, ch.Counterparty.Pubkey, ch.Counterparty)
+}
+
+func (a *memTx) GetChannel(key string) (*core.Channel, error) {
+	b, ok := a.s.channels[key]
+	if !ok {
+		return nil, errs.New(errs.NotFound, "channel not found")
+	}
+	ch, err := a.decodeChannel(b)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (a *memTx) decodeChannel(b []byte) (*core.Channel, error) {
+	ch := &core.Channel{}
+	err := json.Unmarshal(b, ch)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+
+	ab, ok := a.s.accounts[string(ch.Account.Pubkey)]
+	if !ok {
+		return nil, fmt.Errorf("missing account %x", ch.Account.Pubkey)
+	}
+	acct := &core.Account{}
+	err = json.Unmarshal(ab, acct)
+	if err != nil {
+		return nil, err
+	}
+	acct.Judge, err = a.populateJudge(acct.Judge)
+	if err != nil {
+		return nil, err
+	}
+
+	cb, ok := a.s.counterparties[string(ch.Counterparty.Pubkey)]
+	if !ok {
+		return nil, fmt.Errorf("missing counterparty %x", ch.Counterparty.Pubkey)
+	}
+	cpt := &core.Counterparty{}
+	err = json.Unmarshal(cb, cpt)
+	if err != nil {
+		return nil, err
+	}
+	cpt.Judge, err = a.populateJudge(cpt.Judge)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.Judge, err = a.populateJudge(ch.Judge)
+	if err != nil {
+		return nil, err
+	}
+	ch.Account = acct
+	ch.Counterparty = cpt
+
+	return ch, nil
+}
+
+// channels returns the channels that have an index entry under ix, in order
+// of channel id like the bolt indexes. A nil ix matches every channel.
+func (a *memTx) channels(ix *ssb) ([]*core.Channel, error) {
+	keys := []string{}
+	for k := range a.s.channels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	chs := []*core.Channel{}
+	for _, k := range keys {
+		ch, err := a.decodeChannel(a.s.channels[k])
+		if err != nil {
+			return nil, err
+		}
+		if ix != nil && !hasIndex(ch, *ix) {
+			continue
+		}
+		chs = append(chs, ch)
+	}
+	return chs, nil
+}
+
+func hasIndex(ch *core.Channel, ix ssb) bool {
+	for _, ix2 := range indexes(ch) {
+		if ix2.A == ix.A && ix2.B == ix.B && bytes.Equal(ix2.C, ix.C) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *memTx) GetChannels() ([]*core.Channel, error) {
+	return a.channels(nil)
+}
+
+func (a *memTx) GetChannelsByPhase(phase int) ([]*core.Channel, error) {
+	return a.channels(&ssb{"Phase", "Phase", []byte(strconv.Itoa(phase))})
+}
+
+func (a *memTx) GetChannelsByJudge(pubkey []byte) ([]*core.Channel, error) {
+	return a.channels(&ssb{"Judge", "Pubkey", pubkey})
+}
+
+func (a *memTx) GetChannelsByAccount(pubkey []byte) ([]*core.Channel, error) {
+	return a.channels(&ssb{"Account", "Pubkey", pubkey})
+}
+
+func (a *memTx) GetChannelsByCounterparty(pubkey []byte) ([]*core.Channel, error) {
+	return a.channels(&ssb{"Counterparty", "Pubkey", pubkey})
+}
+
+func (a *memTx) GetChannelsAwaitingSignature() ([]*core.Channel, error) {
+	chs, err := a.GetProposedChannels()
+	if err != nil {
+		return nil, err
+	}
+	uchs, err := a.GetProposedUpdateTxs()
+	if err != nil {
+		return nil, err
+	}
+	return append(chs, uchs...), nil
+}
+
+func (a *memTx) GetProposedChannels() ([]*core.Channel, error) {
+	return a.channels(&ssb{"Awaiting", "Signature", []byte("OpeningTx")})
+}
+
+func (a *memTx) GetProposedUpdateTxs() ([]*core.Channel, error) {
+	return a.channels(&ssb{"Awaiting", "Signature", []byte("UpdateTx")})
+}
+
+func (a *memTx) AddOutboxMessage(msg *OutboxMessage) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	a.s.outboxSeq++
+	msg.Id = a.s.outboxSeq
+	return a.SetOutboxMessage(msg)
+}
+
+func (a *memTx) SetOutboxMessage(msg *OutboxMessage) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	a.ownOutbox()[msg.Id] = b
+	return nil
+}
+
+func (a *memTx) GetOutboxMessages() ([]*OutboxMessage, error) {
+	ids := []uint64{}
+	for id := range a.s.outbox {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	msgs := []*OutboxMessage{}
+	for _, id := range ids {
+		msg := &OutboxMessage{}
+		err := json.Unmarshal(a.s.outbox[id], msg)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (a *memTx) DeleteOutboxMessage(id uint64) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	delete(a.ownOutbox(), id)
+	return nil
+}
+
+func (a *memTx) AddHistoryEntry(e *HistoryEntry) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	a.s.historySeq++
+	e.Id = a.s.historySeq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.s.history = append(a.s.history, b)
+	if e.Envelope != nil {
+		a.ownHistoryEvents()[string(historyEvent(e.ChannelId, e.Event, e.Envelope.Payload))] = true
+	}
+	return nil
+}
+
+func (a *memTx) GetHistory(chID string) ([]*HistoryEntry, error) {
+	es := []*HistoryEntry{}
+	for _, b := range a.s.history {
+		e := &HistoryEntry{}
+		err := json.Unmarshal(b, e)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		if e.ChannelId == chID {
+			es = append(es, e)
+		}
+	}
+
+	// Entries were added in Id order, keep it within a sequence number.
+	sort.SliceStable(es, func(i, j int) bool {
+		return es[i].SequenceNumber < es[j].SequenceNumber
+	})
+	return es, nil
+}
+
+func (a *memTx) HasHistoryEvent(chID string, event string, payload []byte) (bool, error) {
+	return a.s.historyEvents[string(historyEvent(chID, event, payload))], nil
+}
+
+func (a *memTx) SetSigning(s *Signing) error {
+	return a.put(&a.s.signing, []byte(s.ChannelId), s)
+}
+
+func (a *memTx) GetSigning(chID string) (*Signing, error) {
+	s := &Signing{ChannelId: chID}
+	b, ok := a.s.signing[chID]
+	if !ok {
+		return s, nil
+	}
+	err := json.Unmarshal(b, s)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return s, nil
+}
+
+func (a *memTx) AddEvidence(e *Evidence) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	a.s.evidenceSeq++
+	e.Id = a.s.evidenceSeq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.s.evidence = append(a.s.evidence, b)
+	return nil
+}
+
+func (a *memTx) GetEvidence(chID string) ([]*Evidence, error) {
+	es := []*Evidence{}
+	for _, b := range a.s.evidence {
+		e := &Evidence{}
+		err := json.Unmarshal(b, e)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		if e.ChannelId == chID {
+			es = append(es, e)
+		}
+	}
+
+	sort.SliceStable(es, func(i, j int) bool {
+		return es[i].SequenceNumber < es[j].SequenceNumber
+	})
+	return es, nil
+}
+
+func (a *memTx) SetKeyParams(p *KeyParams) error {
+	if !a.writable {
+		return errReadOnly
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	a.s.keyParams = b
+	return nil
+}
+
+func (a *memTx) GetKeyParams() (*KeyParams, error) {
+	if a.s.keyParams == nil {
+		return nil, nil
+	}
+	p := &KeyParams{}
+	err := json.Unmarshal(a.s.keyParams, p)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return p, nil
+}
+
+func (a *memTx) SetEncryptedKey(k *EncryptedKey) error {
+	return a.put(&a.s.keys, k.Pubkey, k)
+}
+
+func (a *memTx) GetEncryptedKeys() ([]*EncryptedKey, error) {
+	keys := []string{}
+	for k := range a.s.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ks := []*EncryptedKey{}
+	for _, k := range keys {
+		ek := &EncryptedKey{}
+		err := json.Unmarshal(a.s.keys[k], ek)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		ks = append(ks, ek)
+	}
+	return ks, nil
+}
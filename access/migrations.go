@@ -0,0 +1,298 @@
+package access
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+// Migration upgrades the database from Version-1 to Version. Up returns a
+// description of each change it made.
+type Migration struct {
+	Version     uint64
+	Description string
+	Up          func(tx *bolt.Tx) ([]string, error)
+}
+
+// migrations must be kept in order of Version, with no gaps. Add a migration
+// whenever a change to usc-core or to this package changes what is stored.
+var migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "index channels by phase, account, counterparty and awaiting signature",
+		Up:          reindexChannels,
+	},
+	{
+		Version:     2,
+		Description: "index history entries by event and payload",
+		Up:          reindexHistory,
+	},
+	{
+		Version:     3,
+		Description: "record the highest sequence number signed on each channel, and whether a close was signed",
+		Up:          recordSigning,
+	},
+}
+
+// MigrationResult is what running a migration changed, or would change in a
+// dry run.
+type MigrationResult struct {
+	Version     uint64
+	Description string
+	Changes     []string
+}
+
+var errDryRun = errors.New("dry run")
+
+// SchemaVersion returns the version of the database, 0 if it has never been
+// migrated.
+func SchemaVersion(tx *bolt.Tx) uint64 {
+	b := tx.Bucket([]byte("Meta")).Get([]byte("SchemaVersion"))
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func setSchemaVersion(tx *bolt.Tx, v uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return tx.Bucket([]byte("Meta")).Put([]byte("SchemaVersion"), b)
+}
+
+// LatestSchemaVersion is the version that Migrate brings the database to.
+func LatestSchemaVersion() uint64 {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate runs every migration newer than the database's schema version, all
+// in one transaction. If one fails, none of them are applied. With dryRun, the
+// migrations are run and then rolled back, so the results show what would
+// change. MakeBuckets must be called first, except for a dry run, which makes
+// any missing buckets itself and rolls them back along with the rest.
+func Migrate(db *bolt.DB, dryRun bool) ([]*MigrationResult, error) {
+	var err error
+	results := []*MigrationResult{}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if dryRun {
+			err := makeBuckets(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		v := SchemaVersion(tx)
+		if v > LatestSchemaVersion() {
+			return fmt.Errorf("database schema version %d is newer than this build supports (%d)", v, LatestSchemaVersion())
+		}
+
+		for _, m := range migrations {
+			if m.Version <= v {
+				continue
+			}
+
+			changes, err := m.Up(tx)
+			if err != nil {
+				return fmt.Errorf("migration %d: %v", m.Version, err)
+			}
+
+			err = setSchemaVersion(tx, m.Version)
+			if err != nil {
+				return err
+			}
+
+			results = append(results, &MigrationResult{
+				Version:     m.Version,
+				Description: m.Description,
+				Changes:     changes,
+			})
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// reindexChannels rebuilds the Indexes bucket from the stored channels.
+func reindexChannels(tx *bolt.Tx) ([]string, error) {
+	changes := []string{}
+
+	err := tx.DeleteBucket([]byte("Indexes"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CreateBucket([]byte("Indexes"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
+		ch := &core.Channel{}
+		err := json.Unmarshal(v, ch)
+		if err != nil {
+			return fmt.Errorf("channel %s: %v", k, err)
+		}
+
+		err = putIndexes(tx, ch)
+		if err != nil {
+			return err
+		}
+
+		changes = append(changes, "indexed channel "+ch.ChannelId)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// reindexHistory rebuilds the HistoryEvents bucket from the stored history.
+func reindexHistory(tx *bolt.Tx) ([]string, error) {
+	changes := []string{}
+
+	if tx.Bucket([]byte("HistoryEvents")) != nil {
+		err := tx.DeleteBucket([]byte("HistoryEvents"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := tx.CreateBucket([]byte("HistoryEvents"))
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	err = tx.Bucket([]byte("History")).ForEach(func(k, v []byte) error {
+		e := &HistoryEntry{}
+		err := json.Unmarshal(v, e)
+		if err != nil {
+			return fmt.Errorf("history entry %x: %v", k, err)
+		}
+
+		if e.Envelope != nil {
+			n++
+		}
+		return putHistoryEvent(tx, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 0 {
+		changes = append(changes, fmt.Sprintf("indexed %d history entries", n))
+	}
+	return changes, nil
+}
+
+// recordSigning fills in the Signing bucket from the stored channels and
+// history. Every UpdateTx that we sent or kept locally was signed by us, or
+// refused if it was a rejection, and every LastFullUpdateTx carries our
+// signature. A final UpdateTx that we signed marks the channel as closing.
+func recordSigning(tx *bolt.Tx) ([]string, error) {
+	changes := []string{}
+	ss := map[string]*Signing{}
+	order := []string{}
+
+	get := func(chID string) *Signing {
+		s, ok := ss[chID]
+		if !ok {
+			s = &Signing{ChannelId: chID}
+			ss[chID] = s
+			order = append(order, chID)
+		}
+		return s
+	}
+
+	err := tx.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
+		ch := &core.Channel{}
+		err := json.Unmarshal(v, ch)
+		if err != nil {
+			return fmt.Errorf("channel %s: %v", k, err)
+		}
+
+		if ch.LastFullUpdateTx != nil {
+			s := get(ch.ChannelId)
+			if ch.LastFullUpdateTx.SequenceNumber > s.Sequence {
+				s.Sequence = ch.LastFullUpdateTx.SequenceNumber
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket([]byte("History")).ForEach(func(k, v []byte) error {
+		e := &HistoryEntry{}
+		err := json.Unmarshal(v, e)
+		if err != nil {
+			return fmt.Errorf("history entry %x: %v", k, err)
+		}
+
+		if e.Kind != "UpdateTx" || e.Envelope == nil || (e.Direction != "Sent" && e.Direction != "Local") {
+			return nil
+		}
+
+		s := get(e.ChannelId)
+		if e.SequenceNumber > s.Sequence {
+			s.Sequence = e.SequenceNumber
+		}
+
+		if e.Event != "Rejected" {
+			utx := &wire.UpdateTx{}
+			err = proto.Unmarshal(e.Envelope.Payload, utx)
+			if err != nil {
+				return fmt.Errorf("history entry %x: %v", k, err)
+			}
+			if utx.Fast {
+				s.Closing = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chID := range order {
+		s := ss[chID]
+		have, err := GetSigning(tx, chID)
+		if err != nil {
+			return nil, err
+		}
+		if have.Sequence >= s.Sequence && (have.Closing || !s.Closing) {
+			continue
+		}
+		if have.Sequence > s.Sequence {
+			s.Sequence = have.Sequence
+		}
+		s.Closing = s.Closing || have.Closing
+
+		err = SetSigning(tx, s)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, fmt.Sprintf("channel %s signed up to sequence number %d", chID, s.Sequence))
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,172 @@
+package access
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != uint64(i+1) {
+			t.Fatal("migration", i, "has version", m.Version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  []byte{40, 40, 40},
+		Address: "stoops.com:3004",
+	}
+
+	// A channel saved before the indexes existed.
+	db.Update(func(tx *bolt.Tx) error {
+		ch := &core.Channel{
+			ChannelId:         "old",
+			Phase:             core.OPEN,
+			OpeningTxEnvelope: &wire.Envelope{},
+			Judge:             jd,
+			Account:           &core.Account{Pubkey: []byte{50, 50, 50}, Judge: jd},
+			Counterparty:      &core.Counterparty{Pubkey: []byte{60, 60, 60}, Judge: jd},
+		}
+		err := SetChannel(tx, ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := json.Marshal(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.DeleteBucket([]byte("Indexes"))
+		tx.CreateBucket([]byte("Indexes"))
+		tx.Bucket([]byte("Channels")).Put([]byte("old"), b)
+
+		// And a history entry saved before its event was indexed.
+		err = AddHistoryEntry(tx, &HistoryEntry{ChannelId: "old", Event: "Posted", Envelope: &wire.Envelope{Payload: []byte("utx")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.DeleteBucket([]byte("HistoryEvents"))
+		tx.CreateBucket([]byte("HistoryEvents"))
+
+		// And a close we signed before what we sign was recorded.
+		payload, err := proto.Marshal(&wire.UpdateTx{ChannelId: "old", SequenceNumber: 4, Fast: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = AddHistoryEntry(tx, &HistoryEntry{ChannelId: "old", Kind: "UpdateTx", SequenceNumber: 4, Direction: "Sent", Event: "Proposed", Envelope: &wire.Envelope{Payload: payload}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+
+	posted := func() bool {
+		ok := false
+		db.View(func(tx *bolt.Tx) error {
+			var err error
+			ok, err = HasHistoryEvent(tx, "old", "Posted", []byte("utx"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		})
+		return ok
+	}
+
+	open := func() int {
+		n := 0
+		db.View(func(tx *bolt.Tx) error {
+			chs, err := GetChannelsByPhase(tx, int(core.OPEN))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n = len(chs)
+			return nil
+		})
+		return n
+	}
+
+	signed := func() uint32 {
+		seq := uint32(0)
+		db.View(func(tx *bolt.Tx) error {
+			s, err := GetSigning(tx, "old")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Closing != (s.Sequence != 0) {
+				t.Fatal("signed close not recorded", s)
+			}
+			seq = s.Sequence
+			return nil
+		})
+		return seq
+	}
+
+	version := func() uint64 {
+		v := uint64(0)
+		db.View(func(tx *bolt.Tx) error {
+			v = SchemaVersion(tx)
+			return nil
+		})
+		return v
+	}
+
+	results, err := Migrate(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) || len(results[0].Changes) != 1 {
+		t.Fatal("dry run results incorrect", results)
+	}
+	if version() != 0 || open() != 0 || posted() || signed() != 0 {
+		t.Fatal("dry run changed the database")
+	}
+
+	results, err = Migrate(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) {
+		t.Fatal("results incorrect", results)
+	}
+	if version() != LatestSchemaVersion() || open() != 1 || !posted() || signed() != 4 {
+		t.Fatal("migration not applied", version(), open(), posted(), signed())
+	}
+
+	results, err = Migrate(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatal("migrations ran twice", results)
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, LatestSchemaVersion()+1)
+	})
+	_, err = Migrate(db, false)
+	if err == nil {
+		t.Fatal("migrated a database from a newer version")
+	}
+}
@@ -0,0 +1,91 @@
+package access
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+)
+
+// OutboxMessage is an envelope waiting to be delivered to a counterparty or a
+// judge. Messages are committed in the same transaction as the channel change
+// that produced them, and are deleted once delivered.
+type OutboxMessage struct {
+	Id uint64
+	// Recipient is "Counterparty" or "Judge".
+	Recipient string
+	// Method is the name of the client method used to deliver the envelope,
+	// e.g. "AddUpdateTx".
+	Method    string
+	Address   string
+	ChannelId string
+	Envelope  *wire.Envelope
+	// Reason is sent along with a rejection.
+	Reason string
+
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	// Dead is set once the outbox gives up on the message. It is kept for
+	// inspection, but never sent again.
+	Dead bool
+}
+
+func outboxKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// AddOutboxMessage assigns the message an Id and saves it. Ids increase, so
+// messages are read back in the order they were added.
+func AddOutboxMessage(tx *bolt.Tx, msg *OutboxMessage) error {
+	bkt := tx.Bucket([]byte("Outbox"))
+
+	id, err := bkt.NextSequence()
+	if err != nil {
+		return err
+	}
+	msg.Id = id
+
+	return SetOutboxMessage(tx, msg)
+}
+
+func SetOutboxMessage(tx *bolt.Tx, msg *OutboxMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("Outbox")).Put(outboxKey(msg.Id), b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func GetOutboxMessages(tx *bolt.Tx) ([]*OutboxMessage, error) {
+	var err error
+	msgs := []*OutboxMessage{}
+	err = tx.Bucket([]byte("Outbox")).ForEach(func(k, v []byte) error {
+		msg := &OutboxMessage{}
+		err = json.Unmarshal(v, msg)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return msgs, nil
+}
+
+func DeleteOutboxMessage(tx *bolt.Tx, id uint64) error {
+	return tx.Bucket([]byte("Outbox")).Delete(outboxKey(id))
+}
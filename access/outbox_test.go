@@ -0,0 +1,81 @@
+package access
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestOutbox(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []*OutboxMessage{
+		{
+			Recipient: "Counterparty",
+			Method:    "AddUpdateTx",
+			Address:   "stoops.com:3004",
+			ChannelId: "xyz23",
+			Envelope:  &wire.Envelope{Payload: []byte{1}},
+		},
+		{
+			Recipient: "Judge",
+			Method:    "AddChannel",
+			Address:   "stoops.com:3005",
+			ChannelId: "xyz23",
+			Envelope:  &wire.Envelope{Payload: []byte{2}},
+		},
+	}
+
+	db.Update(func(tx *bolt.Tx) error {
+		for _, msg := range msgs {
+			err := AddOutboxMessage(tx, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		msgs2, err := GetOutboxMessages(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msgs, msgs2) {
+			t.Fatal("Outbox incorrect", msgs, msgs2)
+		}
+		return nil
+	})
+
+	db.Update(func(tx *bolt.Tx) error {
+		err := DeleteOutboxMessage(tx, msgs[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	})
+
+	db.View(func(tx *bolt.Tx) error {
+		msgs2, err := GetOutboxMessages(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs2) != 1 || msgs2[0].Id != msgs[1].Id {
+			t.Fatal("Outbox incorrect", msgs2)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// Signing is what this node has committed to on a channel with its
+// signature. It is kept apart from the channel, because a proposal that is
+// cleared from the channel may still be held, signed, by the counterparty.
+type Signing struct {
+	ChannelId string
+	// Sequence is the highest sequence number of an UpdateTx that this node
+	// has signed or refused to sign. It never goes down. Signing another
+	// UpdateTx at or below it could be equivocation, so new proposals must be
+	// above it.
+	Sequence uint32
+	// Closing is set once this node has signed a final UpdateTx. The
+	// counterparty can post it to the judge at any time, closing the channel
+	// at once, so no other state is signed after it.
+	Closing bool
+}
+
+func SetSigning(tx *bolt.Tx, s *Signing) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("Signing")).Put([]byte(s.ChannelId), b)
+}
+
+// GetSigning returns the Signing of a channel. If nothing has been signed on
+// it yet, the Signing is empty.
+func GetSigning(tx *bolt.Tx, chID string) (*Signing, error) {
+	s := &Signing{ChannelId: chID}
+
+	b := tx.Bucket([]byte("Signing")).Get([]byte(chID))
+	if b == nil {
+		return s, nil
+	}
+
+	err := json.Unmarshal(b, s)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+
+	return s, nil
+}
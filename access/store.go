@@ -0,0 +1,175 @@
+package access
+
+import (
+	"io"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+)
+
+// Store is where a peer keeps its channels, accounts, counterparties, judges,
+// outbox, history, signing and evidence. Everything read or written in one
+// call to Update is committed together, or not at all if fn returns an error.
+type Store interface {
+	Update(fn func(tx Tx) error) error
+	View(fn func(tx Tx) error) error
+}
+
+// Tx is a transaction on a Store. Records returned by a Tx are copies, so
+// changing them has no effect until they are saved. Calling a Set, Add or
+// Delete method on a transaction from View returns an error.
+type Tx interface {
+	SetJudge(jd *core.Judge) error
+	GetJudge(key []byte) (*core.Judge, error)
+
+	SetAccount(acct *core.Account) error
+	GetAccount(key []byte) (*core.Account, error)
+	GetAccounts() ([]*core.Account, error)
+
+	SetCounterparty(cpt *core.Counterparty) error
+	GetCounterparty(key []byte) (*core.Counterparty, error)
+
+	SetChannel(ch *core.Channel) error
+	GetChannel(key string) (*core.Channel, error)
+	GetChannels() ([]*core.Channel, error)
+	GetChannelsByPhase(phase int) ([]*core.Channel, error)
+	GetChannelsByJudge(pubkey []byte) ([]*core.Channel, error)
+	GetChannelsByAccount(pubkey []byte) ([]*core.Channel, error)
+	GetChannelsByCounterparty(pubkey []byte) ([]*core.Channel, error)
+	GetChannelsAwaitingSignature() ([]*core.Channel, error)
+	GetProposedChannels() ([]*core.Channel, error)
+	GetProposedUpdateTxs() ([]*core.Channel, error)
+
+	AddOutboxMessage(msg *OutboxMessage) error
+	SetOutboxMessage(msg *OutboxMessage) error
+	GetOutboxMessages() ([]*OutboxMessage, error)
+	DeleteOutboxMessage(id uint64) error
+
+	AddHistoryEntry(e *HistoryEntry) error
+	GetHistory(chID string) ([]*HistoryEntry, error)
+	HasHistoryEvent(chID string, event string, payload []byte) (bool, error)
+
+	SetSigning(s *Signing) error
+	GetSigning(chID string) (*Signing, error)
+
+	AddEvidence(e *Evidence) error
+	GetEvidence(chID string) ([]*Evidence, error)
+
+	SetKeyParams(p *KeyParams) error
+	GetKeyParams() (*KeyParams, error)
+	SetEncryptedKey(k *EncryptedKey) error
+	GetEncryptedKeys() ([]*EncryptedKey, error)
+}
+
+// Backuper is implemented by stores that can write a snapshot of themselves.
+type Backuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// Bolt is the default Store. MakeBuckets and Migrate must be called on the
+// database before it is used.
+type Bolt struct {
+	DB *bolt.DB
+}
+
+var _ Store = &Bolt{}
+var _ Backuper = &Bolt{}
+
+func (a *Bolt) Update(fn func(tx Tx) error) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (a *Bolt) View(fn func(tx Tx) error) error {
+	return a.DB.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (a *Bolt) Backup(w io.Writer) (int64, error) {
+	return Backup(a.DB, w)
+}
+
+// boltTx implements Tx with the functions in this package.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (a *boltTx) SetJudge(jd *core.Judge) error { return SetJudge(a.tx, jd) }
+
+func (a *boltTx) GetJudge(key []byte) (*core.Judge, error) { return GetJudge(a.tx, key) }
+
+func (a *boltTx) SetAccount(acct *core.Account) error { return SetAccount(a.tx, acct) }
+
+func (a *boltTx) GetAccount(key []byte) (*core.Account, error) { return GetAccount(a.tx, key) }
+
+func (a *boltTx) GetAccounts() ([]*core.Account, error) { return GetAccounts(a.tx) }
+
+func (a *boltTx) SetCounterparty(cpt *core.Counterparty) error { return SetCounterparty(a.tx, cpt) }
+
+func (a *boltTx) GetCounterparty(key []byte) (*core.Counterparty, error) {
+	return GetCounterparty(a.tx, key)
+}
+
+func (a *boltTx) SetChannel(ch *core.Channel) error { return SetChannel(a.tx, ch) }
+
+func (a *boltTx) GetChannel(key string) (*core.Channel, error) { return GetChannel(a.tx, key) }
+
+func (a *boltTx) GetChannels() ([]*core.Channel, error) { return GetChannels(a.tx) }
+
+func (a *boltTx) GetChannelsByPhase(phase int) ([]*core.Channel, error) {
+	return GetChannelsByPhase(a.tx, phase)
+}
+
+func (a *boltTx) GetChannelsByJudge(pubkey []byte) ([]*core.Channel, error) {
+	return GetChannelsByJudge(a.tx, pubkey)
+}
+
+func (a *boltTx) GetChannelsByAccount(pubkey []byte) ([]*core.Channel, error) {
+	return GetChannelsByAccount(a.tx, pubkey)
+}
+
+func (a *boltTx) GetChannelsByCounterparty(pubkey []byte) ([]*core.Channel, error) {
+	return GetChannelsByCounterparty(a.tx, pubkey)
+}
+
+func (a *boltTx) GetChannelsAwaitingSignature() ([]*core.Channel, error) {
+	return GetChannelsAwaitingSignature(a.tx)
+}
+
+func (a *boltTx) GetProposedChannels() ([]*core.Channel, error) { return GetProposedChannels(a.tx) }
+
+func (a *boltTx) GetProposedUpdateTxs() ([]*core.Channel, error) { return GetProposedUpdateTxs(a.tx) }
+
+func (a *boltTx) AddOutboxMessage(msg *OutboxMessage) error { return AddOutboxMessage(a.tx, msg) }
+
+func (a *boltTx) SetOutboxMessage(msg *OutboxMessage) error { return SetOutboxMessage(a.tx, msg) }
+
+func (a *boltTx) GetOutboxMessages() ([]*OutboxMessage, error) { return GetOutboxMessages(a.tx) }
+
+func (a *boltTx) DeleteOutboxMessage(id uint64) error { return DeleteOutboxMessage(a.tx, id) }
+
+func (a *boltTx) AddHistoryEntry(e *HistoryEntry) error { return AddHistoryEntry(a.tx, e) }
+
+func (a *boltTx) GetHistory(chID string) ([]*HistoryEntry, error) { return GetHistory(a.tx, chID) }
+
+func (a *boltTx) HasHistoryEvent(chID string, event string, payload []byte) (bool, error) {
+	return HasHistoryEvent(a.tx, chID, event, payload)
+}
+
+func (a *boltTx) SetSigning(s *Signing) error { return SetSigning(a.tx, s) }
+
+func (a *boltTx) GetSigning(chID string) (*Signing, error) { return GetSigning(a.tx, chID) }
+
+func (a *boltTx) AddEvidence(e *Evidence) error { return AddEvidence(a.tx, e) }
+
+func (a *boltTx) GetEvidence(chID string) ([]*Evidence, error) { return GetEvidence(a.tx, chID) }
+
+func (a *boltTx) SetKeyParams(p *KeyParams) error { return SetKeyParams(a.tx, p) }
+
+func (a *boltTx) GetKeyParams() (*KeyParams, error) { return GetKeyParams(a.tx) }
+
+func (a *boltTx) SetEncryptedKey(k *EncryptedKey) error { return SetEncryptedKey(a.tx, k) }
+
+func (a *boltTx) GetEncryptedKeys() ([]*EncryptedKey, error) { return GetEncryptedKeys(a.tx) }
@@ -0,0 +1,229 @@
+package access
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+)
+
+func TestStores(t *testing.T) {
+	db, err := bolt.Open("/tmp/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]Store{
+		"bolt":   &Bolt{DB: db},
+		"memory": NewMemory(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, store)
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	jd := &core.Judge{
+		Name:    "joe",
+		Pubkey:  []byte{40, 40, 40},
+		Address: "stoops.com:3004",
+	}
+
+	ch := &core.Channel{
+		ChannelId:         "chan",
+		Phase:             core.PENDING_OPEN,
+		Me:                1,
+		OpeningTxEnvelope: &wire.Envelope{Signatures: [][]byte{[]byte{1}}},
+		Judge:             jd,
+		Account:           &core.Account{Name: "me", Pubkey: []byte{50, 50, 50}, Judge: jd},
+		Counterparty:      &core.Counterparty{Name: "them", Pubkey: []byte{60, 60, 60}, Judge: jd},
+	}
+
+	err := store.Update(func(tx Tx) error {
+		return tx.SetChannel(ch)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed Update leaves nothing behind.
+	rollback := errors.New("rollback")
+	err = store.Update(func(tx Tx) error {
+		ch2 := *ch
+		ch2.Phase = core.OPEN
+		err := tx.SetChannel(&ch2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.AddOutboxMessage(&OutboxMessage{ChannelId: "chan"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.AddHistoryEntry(&HistoryEntry{ChannelId: "chan", Event: "Rejected", Envelope: &wire.Envelope{Payload: []byte("utx")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal("expected the error from fn, got", err)
+	}
+
+	err = store.View(func(tx Tx) error {
+		if tx.SetJudge(jd) == nil {
+			t.Fatal("wrote in a read-only transaction")
+		}
+
+		got, err := tx.GetChannel("chan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Phase != core.PENDING_OPEN || got.Account.Name != "me" || got.Counterparty.Judge.Name != "joe" {
+			t.Fatal("channel incorrect", got)
+		}
+
+		msgs, err := tx.GetOutboxMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 0 {
+			t.Fatal("rolled back message was saved", msgs)
+		}
+
+		es, err := tx.GetHistory("chan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := tx.HasHistoryEvent("chan", "Rejected", []byte("utx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 0 || ok {
+			t.Fatal("rolled back history entry was saved", es)
+		}
+
+		chs, err := tx.GetProposedChannels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 1 {
+			t.Fatal("proposed channels incorrect", chs)
+		}
+
+		chs, err = tx.GetChannelsByPhase(int(core.OPEN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chs) != 0 {
+			t.Fatal("rolled back phase change was indexed", chs)
+		}
+
+		_, err = tx.GetChannel("nope")
+		if err == nil {
+			t.Fatal("expected not found")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx Tx) error {
+		for _, seq := range []uint32{3, 1} {
+			err := tx.AddEvidence(&Evidence{ChannelId: "chan", SequenceNumber: seq})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.AddEvidence(&Evidence{ChannelId: "chan2", SequenceNumber: 2})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.View(func(tx Tx) error {
+		es, err := tx.GetEvidence("chan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 2 || es[0].SequenceNumber != 1 || es[1].SequenceNumber != 3 || es[0].Id == 0 {
+			t.Fatal("evidence incorrect", es)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx Tx) error {
+		return tx.AddHistoryEntry(&HistoryEntry{ChannelId: "chan", Event: "Posted", Envelope: &wire.Envelope{Payload: []byte("utx")}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.View(func(tx Tx) error {
+		for _, c := range []struct {
+			chID    string
+			event   string
+			payload string
+			want    bool
+		}{
+			{"chan", "Posted", "utx", true},
+			{"chan", "Rejected", "utx", false},
+			{"chan", "Posted", "other", false},
+			{"chan2", "Posted", "utx", false},
+		} {
+			ok, err := tx.HasHistoryEvent(c.chID, c.event, []byte(c.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.want {
+				t.Fatal("history event", c.chID, c.event, c.payload, "is", ok)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx Tx) error {
+		return tx.SetSigning(&Signing{ChannelId: "chan", Sequence: 5})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.View(func(tx Tx) error {
+		s, err := tx.GetSigning("chan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Sequence != 5 {
+			t.Fatal("signing incorrect", s)
+		}
+
+		s, err = tx.GetSigning("chan2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ChannelId != "chan2" || s.Sequence != 0 {
+			t.Fatal("signing of a channel with nothing signed incorrect", s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
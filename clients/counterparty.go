@@ -2,11 +2,14 @@ package clients
 
 import (
 	"bytes"
-	"errors"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
 )
 
 type Counterparty struct{}
@@ -16,13 +19,69 @@ func (a *Counterparty) Send(ev *wire.Envelope, address string) error {
 
 	resp, err := http.Post(address, "application/octet-stream", bytes.NewReader(b))
 	if err != nil {
-		return errors.New("network error")
+		return errs.New(errs.PeerUnreachable, "network error")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return errors.New("counterparty error")
+		return peerError("counterparty", resp)
 	}
 
 	return nil
 }
+
+// AddChannel sends a proposed OpeningTx to the counterparty.
+func (a *Counterparty) AddChannel(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_channel")
+}
+
+// AddUpdateTx sends a proposed UpdateTx to the counterparty.
+func (a *Counterparty) AddUpdateTx(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_update_tx")
+}
+
+// AddFullUpdateTx sends an UpdateTx that we have confirmed back to the
+// counterparty that proposed it.
+func (a *Counterparty) AddFullUpdateTx(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_full_update_tx")
+}
+
+// RejectChannel tells the counterparty that we have declined its OpeningTx.
+func (a *Counterparty) RejectChannel(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/reject_channel")
+}
+
+// RejectUpdateTx tells the counterparty that we have declined its proposed
+// UpdateTx, and why.
+func (a *Counterparty) RejectUpdateTx(ev *wire.Envelope, reason string, address string) error {
+	return a.Send(ev, address+"/reject_update_tx?reason="+url.QueryEscape(reason))
+}
+
+// ProposeClose sends the counterparty a final UpdateTx for a cooperative
+// close.
+func (a *Counterparty) ProposeClose(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/propose_close")
+}
+
+// peerError turns an error response from a counterparty or judge into a
+// PeerRejected or PeerUnreachable error, keeping the peer's own code in the
+// message. If the peer sent a code, that decides which, rather than the
+// status.
+func peerError(peer string, resp *http.Response) error {
+	data := struct {
+		Error string
+		Code  errs.Code
+	}{}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		json.Unmarshal(b, &data)
+	}
+
+	if data.Code == "" {
+		return errs.New(errs.FromStatus(resp.StatusCode), peer+" error: "+resp.Status)
+	}
+
+	code := errs.FromStatus(errs.Status(data.Code))
+	return errs.New(code, peer+" error: "+string(data.Code)+": "+data.Error)
+}
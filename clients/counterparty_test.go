@@ -0,0 +1,36 @@
+package clients
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestPeerError(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body   string
+		code   errs.Code
+	}{
+		{412, `{"Error":"hold period is over","Code":"WRONG_PHASE"}`, errs.PeerRejected},
+		{500, `{"Error":"database error","Code":"INTERNAL"}`, errs.PeerUnreachable},
+		{502, `{"Error":"counterparty error: NOT_FOUND: channel not found","Code":"PEER_REJECTED"}`, errs.PeerUnreachable},
+		{500, ``, errs.PeerUnreachable},
+		{404, ``, errs.PeerRejected},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+
+		err := (&Counterparty{}).AddUpdateTx(&wire.Envelope{}, srv.URL)
+		srv.Close()
+
+		if errs.CodeOf(err) != c.code {
+			t.Fatal(c.status, c.body, "gave", errs.CodeOf(err), err)
+		}
+	}
+}
@@ -2,27 +2,234 @@ package clients
 
 import (
 	"bytes"
-	"errors"
+	"encoding/binary"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
 )
 
 type Judge struct{}
 
+// ChannelStatus is the judge's view of a channel.
+type ChannelStatus struct {
+	ChannelId string
+	// Phase is one of PENDING_OPEN, OPEN, PENDING_CLOSED or CLOSED.
+	Phase string
+	// HoldPeriodStart is when the judge received the first UpdateTx for the
+	// channel. It is zero if no UpdateTx has been posted.
+	HoldPeriodStart time.Time
+}
+
+// statusMsg is the protobuf message that the judge serves a ChannelStatus as.
+// usc-core/wire has no message for it, so its schema is kept here, and is as
+// much a part of the judge's API as the wire messages are:
+//
+//	message ChannelStatus {
+//	  string channel_id = 1;
+//	  string phase = 2;
+//	  int64 hold_period_start = 3; // nanoseconds since the unix epoch, 0 if not started
+//	}
+//
+// Field numbers and types must never change or be reused, only new fields
+// added, so that judges and peers of different versions can read each other.
+type statusMsg struct {
+	ChannelId       string `protobuf:"bytes,1,opt,name=channel_id,proto3" json:"channel_id,omitempty"`
+	Phase           string `protobuf:"bytes,2,opt,name=phase,proto3" json:"phase,omitempty"`
+	HoldPeriodStart int64  `protobuf:"varint,3,opt,name=hold_period_start,proto3" json:"hold_period_start,omitempty"`
+}
+
+func (m *statusMsg) Reset()         { *m = statusMsg{} }
+func (m *statusMsg) String() string { return proto.CompactTextString(m) }
+func (*statusMsg) ProtoMessage()    {}
+
+// MarshalStatus encodes a ChannelStatus as the protobuf message that
+// GetStatus reads.
+func MarshalStatus(st *ChannelStatus) ([]byte, error) {
+	msg := &statusMsg{ChannelId: st.ChannelId, Phase: st.Phase}
+	if !st.HoldPeriodStart.IsZero() {
+		msg.HoldPeriodStart = st.HoldPeriodStart.UnixNano()
+	}
+	return proto.Marshal(msg)
+}
+
+// UnmarshalStatus decodes a ChannelStatus encoded by MarshalStatus.
+func UnmarshalStatus(b []byte) (*ChannelStatus, error) {
+	msg := &statusMsg{}
+	err := proto.Unmarshal(b, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &ChannelStatus{ChannelId: msg.ChannelId, Phase: msg.Phase}
+	if msg.HoldPeriodStart != 0 {
+		st.HoldPeriodStart = time.Unix(0, msg.HoldPeriodStart)
+	}
+	return st, nil
+}
+
+// RejectionMessage is what a participant signs to reject an OpeningTx or an
+// UpdateTx: the payload and the reason for rejecting it, behind a prefix.
+// Signing this instead of the payload means a rejection can never be passed
+// off as a signature on the tx itself.
+func RejectionMessage(payload []byte, reason string) []byte {
+	n := make([]byte, binary.MaxVarintLen64)
+	n = n[:binary.PutUvarint(n, uint64(len(reason)))]
+
+	msg := []byte("usc rejection\n")
+	msg = append(msg, n...)
+	msg = append(msg, reason...)
+	return append(msg, payload...)
+}
+
+// FulfillmentMessage is what a participant signs to submit a fulfillment to
+// the judge: the channel id and the payload, behind a prefix. Signing this
+// instead of the bare payload means a fulfillment signature can never be passed
+// off as a signature on a tx, nor replayed on another channel.
+func FulfillmentMessage(chID string, payload []byte) []byte {
+	n := make([]byte, binary.MaxVarintLen64)
+	n = n[:binary.PutUvarint(n, uint64(len(chID)))]
+
+	msg := []byte("usc fulfillment\n")
+	msg = append(msg, n...)
+	msg = append(msg, chID...)
+	return append(msg, payload...)
+}
+
 func (a *Judge) Send(ev *wire.Envelope, address string) error {
 	b, err := proto.Marshal(ev)
 
 	resp, err := http.Post(address, "application/octet-stream", bytes.NewReader(b))
 	if err != nil {
-		return errors.New("network error")
+		return errs.New(errs.PeerUnreachable, "network error")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return errors.New("counterparty error")
+		return peerError("judge", resp)
 	}
 
 	return nil
 }
+
+// AddChannel sends a fully signed OpeningTx to the judge.
+func (a *Judge) AddChannel(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_channel")
+}
+
+// AddUpdateTx posts a fully signed UpdateTx to the judge, starting the hold
+// period if it has not already started.
+func (a *Judge) AddUpdateTx(ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_update_tx")
+}
+
+// AddFulfillment sends a signed fulfillment for a channel to the judge.
+func (a *Judge) AddFulfillment(chID string, ev *wire.Envelope, address string) error {
+	return a.Send(ev, address+"/add_fulfillment?ChannelId="+url.QueryEscape(chID))
+}
+
+// GetOpeningTx fetches the OpeningTx envelope the judge is serving for a channel.
+// It returns nil if the judge does not have one yet.
+func (a *Judge) GetOpeningTx(chID string, address string) (*wire.Envelope, error) {
+	return a.getEnvelope(address+"/get_opening_tx", chID)
+}
+
+// GetUpdateTx fetches the UpdateTx envelope that has been posted to the judge
+// for a channel. It returns nil if no UpdateTx has been posted.
+func (a *Judge) GetUpdateTx(chID string, address string) (*wire.Envelope, error) {
+	return a.getEnvelope(address+"/get_update_tx", chID)
+}
+
+// GetStatus fetches the phase of a channel and the start of its hold period
+// from the judge. It returns nil if the judge does not know the channel.
+func (a *Judge) GetStatus(chID string, address string) (*ChannelStatus, error) {
+	b, err := a.get(address+"/get_status", chID)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	st, err := UnmarshalStatus(b)
+	if err != nil {
+		return nil, errs.New(errs.PeerRejected, "judge error")
+	}
+
+	return st, nil
+}
+
+// GetFulfillments fetches the signed fulfillments the judge has stored for a
+// channel. The judge serves them as a series of length-prefixed envelopes.
+func (a *Judge) GetFulfillments(chID string, address string) ([]*wire.Envelope, error) {
+	b, err := a.get(address+"/get_fulfillments", chID)
+	if err != nil {
+		return nil, err
+	}
+
+	evs := []*wire.Envelope{}
+	for len(b) > 0 {
+		l, n := proto.DecodeVarint(b)
+		if n == 0 || l > uint64(len(b)-n) {
+			return nil, errs.New(errs.PeerRejected, "judge error")
+		}
+
+		ev := &wire.Envelope{}
+		err = proto.Unmarshal(b[n:n+int(l)], ev)
+		if err != nil {
+			return nil, errs.New(errs.PeerRejected, "judge error")
+		}
+		evs = append(evs, ev)
+
+		b = b[n+int(l):]
+	}
+
+	return evs, nil
+}
+
+func (a *Judge) getEnvelope(endpoint string, chID string) (*wire.Envelope, error) {
+	b, err := a.get(endpoint, chID)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	ev := &wire.Envelope{}
+	err = proto.Unmarshal(b, ev)
+	if err != nil {
+		return nil, errs.New(errs.PeerRejected, "judge error")
+	}
+
+	return ev, nil
+}
+
+// get fetches a channel's resource from the judge. It returns nil if the judge
+// responds with 404.
+func (a *Judge) get(endpoint string, chID string) ([]byte, error) {
+	resp, err := http.Get(endpoint + "?ChannelId=" + url.QueryEscape(chID))
+	if err != nil {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, peerError("judge", resp)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+
+	return b, nil
+}
@@ -0,0 +1,55 @@
+package clients
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStatusEncoding(t *testing.T) {
+	start := time.Unix(0, 1500000000123456789)
+
+	// The encoding of ChannelStatus{channel_id: "ab", phase: "OPEN",
+	// hold_period_start: 1500000000123456789}, field by field, so that a
+	// change to the schema shows up here.
+	golden := []byte{
+		0x0a, 0x02, 'a', 'b',
+		0x12, 0x04, 'O', 'P', 'E', 'N',
+		0x18, 0x95, 0x9a, 0xc7, 0x93, 0xd8, 0xc1, 0xc4, 0xe8, 0x14,
+	}
+
+	b, err := MarshalStatus(&ChannelStatus{ChannelId: "ab", Phase: "OPEN", HoldPeriodStart: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, golden) {
+		t.Fatalf("status encoding changed: %x", b)
+	}
+
+	st, err := UnmarshalStatus(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ChannelId != "ab" || st.Phase != "OPEN" || !st.HoldPeriodStart.Equal(start) {
+		t.Fatal("status not decoded", st)
+	}
+
+	// A status from a newer judge, with a field this version does not know.
+	st, err = UnmarshalStatus(append(golden, 0x20, 0x01))
+	if err != nil || st.Phase != "OPEN" {
+		t.Fatal("status with an unknown field not decoded", st, err)
+	}
+
+	// Before the hold period starts, the field is left out.
+	b, err = MarshalStatus(&ChannelStatus{ChannelId: "ab", Phase: "OPEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, golden[:10]) {
+		t.Fatalf("status encoding changed: %x", b)
+	}
+	st, err = UnmarshalStatus(b)
+	if err != nil || !st.HoldPeriodStart.IsZero() {
+		t.Fatal("hold period start not zero", st, err)
+	}
+}
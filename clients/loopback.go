@@ -0,0 +1,230 @@
+package clients
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// LoopbackCounterparty delivers envelopes to counterparties in the same
+// process, looking them up by address.
+type LoopbackCounterparty struct {
+	Handlers map[string]CounterpartyHandler
+}
+
+func (a *LoopbackCounterparty) AddChannel(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddChannel(ev))
+}
+
+func (a *LoopbackCounterparty) RejectChannel(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.RejectChannel(ev))
+}
+
+func (a *LoopbackCounterparty) AddUpdateTx(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddUpdateTx(ev))
+}
+
+func (a *LoopbackCounterparty) AddFullUpdateTx(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddFullUpdateTx(ev))
+}
+
+func (a *LoopbackCounterparty) RejectUpdateTx(ev *wire.Envelope, reason string, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.RejectUpdateTx(ev, reason))
+}
+
+func (a *LoopbackCounterparty) ProposeClose(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.ProposeClose(ev))
+}
+
+func (a *LoopbackCounterparty) handler(address string) (CounterpartyHandler, error) {
+	h, ok := a.Handlers[address]
+	if !ok {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+	return h, nil
+}
+
+// LoopbackJudge delivers envelopes to judges in the same process, looking them
+// up by address.
+type LoopbackJudge struct {
+	Handlers map[string]JudgeHandler
+}
+
+func (a *LoopbackJudge) AddChannel(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddChannel(ev))
+}
+
+func (a *LoopbackJudge) AddUpdateTx(ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddUpdateTx(ev))
+}
+
+func (a *LoopbackJudge) AddFulfillment(chID string, ev *wire.Envelope, address string) error {
+	h, err := a.handler(address)
+	if err != nil {
+		return err
+	}
+	ev, err = copyEnvelope(ev)
+	if err != nil {
+		return err
+	}
+	return rejected(h.AddFulfillment(chID, ev))
+}
+
+func (a *LoopbackJudge) GetOpeningTx(chID string, address string) (*wire.Envelope, error) {
+	h, err := a.handler(address)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := h.GetOpeningTx(chID)
+	err = rejected(err)
+	if err != nil || ev == nil {
+		return nil, err
+	}
+	return copyEnvelope(ev)
+}
+
+func (a *LoopbackJudge) GetUpdateTx(chID string, address string) (*wire.Envelope, error) {
+	h, err := a.handler(address)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := h.GetUpdateTx(chID)
+	err = rejected(err)
+	if err != nil || ev == nil {
+		return nil, err
+	}
+	return copyEnvelope(ev)
+}
+
+func (a *LoopbackJudge) GetStatus(chID string, address string) (*ChannelStatus, error) {
+	h, err := a.handler(address)
+	if err != nil {
+		return nil, err
+	}
+	st, err := h.GetStatus(chID)
+	err = rejected(err)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	st2 := *st
+	return &st2, nil
+}
+
+func (a *LoopbackJudge) GetFulfillments(chID string, address string) ([]*wire.Envelope, error) {
+	h, err := a.handler(address)
+	if err != nil {
+		return nil, err
+	}
+	evs, err := h.GetFulfillments(chID)
+	err = rejected(err)
+	if err != nil {
+		return nil, err
+	}
+	evs2 := []*wire.Envelope{}
+	for _, ev := range evs {
+		ev, err = copyEnvelope(ev)
+		if err != nil {
+			return nil, err
+		}
+		evs2 = append(evs2, ev)
+	}
+	return evs2, nil
+}
+
+func (a *LoopbackJudge) handler(address string) (JudgeHandler, error) {
+	h, ok := a.Handlers[address]
+	if !ok {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+	return h, nil
+}
+
+// rejected wraps an error from a handler as PeerRejected, or PeerUnreachable if
+// it is the handler's own failure, as it would be if it had come back over the
+// network.
+func rejected(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := errs.FromStatus(errs.Status(errs.CodeOf(err)))
+	return errs.New(code, "peer error: "+string(errs.CodeOf(err))+": "+err.Error())
+}
+
+// copyEnvelope round trips an envelope through protobuf, so that the two ends
+// of a loopback never share memory, just as if it had crossed the network.
+func copyEnvelope(ev *wire.Envelope) (*wire.Envelope, error) {
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+	ev2 := &wire.Envelope{}
+	err = proto.Unmarshal(b, ev2)
+	if err != nil {
+		return nil, errs.New(errs.PeerUnreachable, "network error")
+	}
+	return ev2, nil
+}
@@ -0,0 +1,55 @@
+package clients
+
+import "github.com/jtremback/usc-core/wire"
+
+// CounterpartyTransport sends envelopes to a counterparty. Counterparty sends
+// them over HTTP.
+type CounterpartyTransport interface {
+	AddChannel(ev *wire.Envelope, address string) error
+	RejectChannel(ev *wire.Envelope, address string) error
+	AddUpdateTx(ev *wire.Envelope, address string) error
+	AddFullUpdateTx(ev *wire.Envelope, address string) error
+	RejectUpdateTx(ev *wire.Envelope, reason string, address string) error
+	ProposeClose(ev *wire.Envelope, address string) error
+}
+
+// JudgeTransport sends envelopes to a judge and reads back the judge's view of
+// a channel. Judge does this over HTTP.
+type JudgeTransport interface {
+	AddChannel(ev *wire.Envelope, address string) error
+	AddUpdateTx(ev *wire.Envelope, address string) error
+	AddFulfillment(chID string, ev *wire.Envelope, address string) error
+	GetOpeningTx(chID string, address string) (*wire.Envelope, error)
+	GetUpdateTx(chID string, address string) (*wire.Envelope, error)
+	GetStatus(chID string, address string) (*ChannelStatus, error)
+	GetFulfillments(chID string, address string) ([]*wire.Envelope, error)
+}
+
+// CounterpartyHandler is the receiving end of a CounterpartyTransport. It is
+// implemented by logic.Counterparty.
+type CounterpartyHandler interface {
+	AddChannel(ev *wire.Envelope) error
+	RejectChannel(ev *wire.Envelope) error
+	AddUpdateTx(ev *wire.Envelope) error
+	AddFullUpdateTx(ev *wire.Envelope) error
+	RejectUpdateTx(ev *wire.Envelope, reason string) error
+	ProposeClose(ev *wire.Envelope) error
+}
+
+// JudgeHandler is the receiving end of a JudgeTransport.
+type JudgeHandler interface {
+	AddChannel(ev *wire.Envelope) error
+	AddUpdateTx(ev *wire.Envelope) error
+	AddFulfillment(chID string, ev *wire.Envelope) error
+	GetOpeningTx(chID string) (*wire.Envelope, error)
+	GetUpdateTx(chID string) (*wire.Envelope, error)
+	GetStatus(chID string) (*ChannelStatus, error)
+	GetFulfillments(chID string) ([]*wire.Envelope, error)
+}
+
+var (
+	_ CounterpartyTransport = &Counterparty{}
+	_ CounterpartyTransport = &LoopbackCounterparty{}
+	_ JudgeTransport        = &Judge{}
+	_ JudgeTransport        = &LoopbackJudge{}
+)
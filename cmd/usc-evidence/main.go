@@ -0,0 +1,62 @@
+// Command usc-evidence checks evidence of equivocation exported from a peer's
+// caller API with /get_evidence. It needs nothing but the file, so a judge or
+// anyone else can use it to check a peer's claim that its counterparty signed
+// two different UpdateTxs with the same sequence number.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jtremback/usc-peer/access"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: usc-evidence file.json")
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	// The file holds the list returned by /get_evidence, or a single piece of
+	// evidence taken from it.
+	es := []*access.Evidence{}
+	err = json.Unmarshal(b, &es)
+	if err != nil {
+		e := &access.Evidence{}
+		err = json.Unmarshal(b, e)
+		if err != nil {
+			fmt.Println("evidence does not parse:", err)
+			os.Exit(2)
+		}
+		es = append(es, e)
+	}
+
+	invalid := 0
+	for _, e := range es {
+		err := e.Verify()
+		if err != nil {
+			fmt.Printf("channel %s sequence number %d: not proven: %v\n", e.ChannelId, e.SequenceNumber, err)
+			invalid++
+			continue
+		}
+		fmt.Printf("channel %s sequence number %d: participant %d signed two different UpdateTxs\n", e.ChannelId, e.SequenceNumber, e.Signer)
+	}
+
+	if invalid > 0 || len(es) == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+// Command usc-fsck checks a peer's database for inconsistencies, and
+// optionally repairs them. The peer should not be running.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-peer/access"
+)
+
+func main() {
+	path := flag.String("db", "main.db", "path of the peer's database")
+	repair := flag.Bool("repair", false, "repair the problems that can be repaired")
+	flag.Parse()
+
+	db, err := bolt.Open(*path, 0600, &bolt.Options{
+		ReadOnly: !*repair,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	problems, err := access.Check(db, *repair)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	unrepaired := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	fmt.Printf("%d problems, %d repaired\n", len(problems), len(problems)-unrepaired)
+
+	if unrepaired > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
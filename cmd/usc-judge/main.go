@@ -0,0 +1,67 @@
+// Command usc-judge runs a reference judge for development and integration
+// tests.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-peer/judge"
+)
+
+func main() {
+	addr := flag.String("addr", ":3401", "address to serve the judge to peers on")
+	adminAddr := flag.String("admin", "127.0.0.1:3402", "address to serve the operator API on, which must not be reachable by peers")
+	path := flag.String("db", "judge.db", "path of the judge's database")
+	autoConfirm := flag.Bool("auto-confirm", true, "confirm every valid channel as soon as it arrives")
+	flag.Parse()
+
+	db, err := bolt.Open(*path, 0600, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer db.Close()
+
+	err = judge.MakeBuckets(db)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	jd := &judge.Judge{
+		DB:          db,
+		AutoConfirm: *autoConfirm,
+	}
+
+	pubkey, err := jd.Pubkey()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("judge pubkey:", base64.StdEncoding.EncodeToString(pubkey))
+
+	jd.Start(time.Second)
+	defer jd.Stop()
+
+	mux := http.NewServeMux()
+	adminMux := http.NewServeMux()
+	srv := &judge.HTTP{
+		Judge: jd,
+	}
+	srv.MountRoutes(mux)
+	srv.MountAdminRoutes(adminMux)
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- http.ListenAndServe(*addr, mux)
+	}()
+	go func() {
+		errs <- http.ListenAndServe(*adminAddr, adminMux)
+	}()
+	fmt.Println(<-errs)
+}
@@ -0,0 +1,155 @@
+// Command usc-restore replaces a peer's database with a backup taken from the
+// caller API's /backup endpoint. The peer must be stopped first.
+//
+// Restoring old channel state is dangerous: if the counterparty holds a later
+// UpdateTx, they can post it and we will not know to answer with ours. The
+// command lists every channel that is not closed, and refuses to go on if the
+// database being replaced holds a later state for any of them, unless -force
+// is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-peer/access"
+)
+
+func main() {
+	path := flag.String("db", "main.db", "path of the peer's database")
+	backupPath := flag.String("backup", "", "path of the backup to restore")
+	force := flag.Bool("force", false, "restore even if the database being replaced holds later channel state")
+	flag.Parse()
+
+	if *backupPath == "" {
+		fmt.Println("-backup is required")
+		os.Exit(2)
+	}
+
+	err := restore(*path, *backupPath, *force)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func restore(path string, backupPath string, force bool) error {
+	opts := &bolt.Options{ReadOnly: true, Timeout: time.Second}
+
+	backup, err := bolt.Open(backupPath, 0600, opts)
+	if err != nil {
+		return fmt.Errorf("opening backup: %v", err)
+	}
+	defer backup.Close()
+
+	problems, err := access.Check(backup, false)
+	if err != nil {
+		return fmt.Errorf("checking backup: %v", err)
+	}
+	for _, p := range problems {
+		fmt.Println("backup:", p)
+	}
+
+	var current *bolt.DB
+	_, err = os.Stat(path)
+	if err == nil {
+		current, err = bolt.Open(path, 0600, opts)
+		if err != nil {
+			return fmt.Errorf("opening %s, is the peer still running? %v", path, err)
+		}
+		defer current.Close()
+	}
+
+	newer := 0
+	err = backup.View(func(btx *bolt.Tx) error {
+		if current == nil {
+			return report(btx, nil, &newer)
+		}
+		return current.View(func(ctx *bolt.Tx) error {
+			return report(btx, ctx, &newer)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if newer > 0 && !force {
+		return fmt.Errorf("%s holds later state for %d channels, not restoring without -force", path, newer)
+	}
+
+	// Close both before files are moved around.
+	backup.Close()
+	if current != nil {
+		current.Close()
+
+		old := path + ".before-restore." + time.Now().Format("20060102150405")
+		err = os.Rename(path, old)
+		if err != nil {
+			return err
+		}
+		fmt.Println("moved", path, "to", old)
+	}
+
+	err = copyFile(backupPath, path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("restored", backupPath, "to", path)
+	return nil
+}
+
+func report(backup *bolt.Tx, current *bolt.Tx, newer *int) error {
+	stale, err := access.CompareStates(backup, current)
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		fmt.Println("WARNING: the backup may hold older state than the counterparty for these channels.")
+		fmt.Println("Check with the counterparty and the judge before closing them.")
+	}
+	for _, s := range stale {
+		fmt.Printf("  %s %s sequence number %d: %s\n", s.ChannelId, s.Phase, s.SequenceNumber, s.Msg)
+		if s.Newer {
+			*newer++
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies src to a temporary file next to dst, then renames it, so that
+// dst is never left half written.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,90 @@
+// Package errs defines the kinds of error that the API reports, so that
+// clients can tell them apart without parsing messages.
+package errs
+
+import (
+	"errors"
+	"net/http"
+)
+
+type Code string
+
+const (
+	BadRequest       Code = "BAD_REQUEST"
+	NotFound         Code = "NOT_FOUND"
+	AlreadyExists    Code = "ALREADY_EXISTS"
+	InvalidSignature Code = "INVALID_SIGNATURE"
+	StaleSequence    Code = "STALE_SEQUENCE"
+	WrongPhase       Code = "WRONG_PHASE"
+	PeerUnreachable  Code = "PEER_UNREACHABLE"
+	PeerRejected     Code = "PEER_REJECTED"
+	Locked           Code = "LOCKED"
+	WrongPassphrase  Code = "WRONG_PASSPHRASE"
+	Internal         Code = "INTERNAL"
+)
+
+// Error is an error with a Code.
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func New(code Code, msg string) error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// CodeOf returns the Code of err, or Internal if it does not have one.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Internal
+}
+
+// Is checks whether err has the code.
+func Is(err error, code Code) bool {
+	return CodeOf(err) == code
+}
+
+// Status is the HTTP status code that the API responds with for an error with
+// this Code.
+func Status(code Code) int {
+	switch code {
+	case BadRequest:
+		return http.StatusBadRequest
+	case InvalidSignature:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case AlreadyExists:
+		return http.StatusConflict
+	case WrongPhase:
+		return http.StatusPreconditionFailed
+	case StaleSequence:
+		return http.StatusUnprocessableEntity
+	case PeerRejected:
+		return http.StatusBadGateway
+	case PeerUnreachable:
+		return http.StatusServiceUnavailable
+	case Locked:
+		return http.StatusLocked
+	case WrongPassphrase:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// FromStatus is the Code for an error response from a peer. A 5xx status
+// means the peer could not handle the request right now, and it is worth trying
+// again, anything else means the peer refused it.
+func FromStatus(status int) Code {
+	if status >= http.StatusInternalServerError {
+		return PeerUnreachable
+	}
+	return PeerRejected
+}
@@ -0,0 +1,47 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	err := New(StaleSequence, "sequence number too low")
+	if CodeOf(err) != StaleSequence {
+		t.Fatal("wrong code", CodeOf(err))
+	}
+
+	if CodeOf(fmt.Errorf("wrapped: %w", err)) != StaleSequence {
+		t.Fatal("wrapped error lost its code")
+	}
+
+	if CodeOf(errors.New("database error")) != Internal {
+		t.Fatal("plain error should be internal")
+	}
+}
+
+func TestStatusDistinct(t *testing.T) {
+	seen := map[int]Code{}
+	for _, code := range []Code{BadRequest, NotFound, AlreadyExists, InvalidSignature, StaleSequence, WrongPhase, PeerUnreachable, PeerRejected, Locked, WrongPassphrase, Internal} {
+		s := Status(code)
+		if other, ok := seen[s]; ok {
+			t.Fatal(code, "and", other, "share status", s)
+		}
+		seen[s] = code
+	}
+}
+
+func TestFromStatus(t *testing.T) {
+	for status, code := range map[int]Code{
+		400: PeerRejected,
+		412: PeerRejected,
+		500: PeerUnreachable,
+		502: PeerUnreachable,
+		503: PeerUnreachable,
+	} {
+		if FromStatus(status) != code {
+			t.Fatal(status, "gave", FromStatus(status))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package judge
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+)
+
+const (
+	PENDING_OPEN   = "PENDING_OPEN"
+	OPEN           = "OPEN"
+	PENDING_CLOSED = "PENDING_CLOSED"
+	CLOSED         = "CLOSED"
+)
+
+// Channel is the judge's record of a channel.
+type Channel struct {
+	ChannelId string
+	Phase     string
+
+	OpeningTx         *wire.OpeningTx
+	OpeningTxEnvelope *wire.Envelope
+
+	UpdateTx         *wire.UpdateTx
+	UpdateTxEnvelope *wire.Envelope
+
+	HoldPeriodStart time.Time
+	Fulfillments    []*wire.Envelope
+}
+
+// HoldPeriodEnd is when the channel will close. It is zero if the hold period
+// has not started.
+func (ch *Channel) HoldPeriodEnd() time.Time {
+	if ch.HoldPeriodStart.IsZero() {
+		return time.Time{}
+	}
+	return ch.HoldPeriodStart.Add(time.Duration(ch.OpeningTx.HoldPeriod) * time.Second)
+}
+
+func MakeBuckets(db *bolt.DB) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("Channels"))
+		_, err = tx.CreateBucketIfNotExists([]byte("Keys"))
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetKey returns the judge's keypair, generating one the first time it is
+// called.
+func GetKey(tx *bolt.Tx) (ed25519.PrivateKey, error) {
+	bkt := tx.Bucket([]byte("Keys"))
+	priv := bkt.Get([]byte("Judge"))
+	if priv != nil {
+		return ed25519.PrivateKey(append([]byte{}, priv...)), nil
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bkt.Put([]byte("Judge"), priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.PrivateKey(priv), nil
+}
+
+func SetChannel(tx *bolt.Tx, ch *Channel) error {
+	b, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("Channels")).Put([]byte(ch.ChannelId), b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetChannel returns nil if there is no channel with the key.
+func GetChannel(tx *bolt.Tx, key string) (*Channel, error) {
+	b := tx.Bucket([]byte("Channels")).Get([]byte(key))
+	if b == nil {
+		return nil, nil
+	}
+	ch := &Channel{}
+	err := json.Unmarshal(b, ch)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return ch, nil
+}
+
+func GetChannels(tx *bolt.Tx) ([]*Channel, error) {
+	var err error
+	chs := []*Channel{}
+	err = tx.Bucket([]byte("Channels")).ForEach(func(k, v []byte) error {
+		ch := &Channel{}
+		err = json.Unmarshal(v, ch)
+		if err != nil {
+			return err
+		}
+		chs = append(chs, ch)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+	return chs, nil
+}
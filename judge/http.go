@@ -0,0 +1,229 @@
+package judge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// HTTP serves a Judge to peers, in the format read by clients.Judge.
+type HTTP struct {
+	Judge *Judge
+}
+
+// maxBodySize is the most we read of a request. Anyone can reach this
+// listener, and no envelope comes anywhere close.
+const maxBodySize = 1 << 20
+
+// MountRoutes mounts the routes that peers use. Anyone can reach these.
+func (a *HTTP) MountRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/add_channel", a.addChannel)
+	mux.HandleFunc("/add_update_tx", a.addUpdateTx)
+	mux.HandleFunc("/add_fulfillment", a.addFulfillment)
+	mux.HandleFunc("/get_opening_tx", a.getOpeningTx)
+	mux.HandleFunc("/get_update_tx", a.getUpdateTx)
+	mux.HandleFunc("/get_status", a.getStatus)
+	mux.HandleFunc("/get_fulfillments", a.getFulfillments)
+}
+
+// MountAdminRoutes mounts the routes that the judge's operator uses. They must
+// only be served on a listener that peers can't reach.
+func (a *HTTP) MountAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/confirm_channel", a.confirmChannel)
+}
+
+func (a *HTTP) addChannel(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	err = a.Judge.AddChannel(ev)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *HTTP) confirmChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Judge.ConfirmChannel(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *HTTP) addUpdateTx(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	err = a.Judge.AddUpdateTx(ev)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *HTTP) addFulfillment(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	err = a.Judge.AddFulfillment(r.URL.Query().Get("ChannelId"), ev)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *HTTP) getOpeningTx(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.Judge.GetOpeningTx(r.URL.Query().Get("ChannelId"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.sendEnvelope(w, ev)
+}
+
+func (a *HTTP) getUpdateTx(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.Judge.GetUpdateTx(r.URL.Query().Get("ChannelId"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.sendEnvelope(w, ev)
+}
+
+func (a *HTTP) getStatus(w http.ResponseWriter, r *http.Request) {
+	st, err := a.Judge.GetStatus(r.URL.Query().Get("ChannelId"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	if st == nil {
+		a.fail(w, errs.New(errs.NotFound, "channel not found"))
+		return
+	}
+
+	b, err := clients.MarshalStatus(st)
+	if err != nil {
+		a.fail(w, errs.New(errs.Internal, "server error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (a *HTTP) getFulfillments(w http.ResponseWriter, r *http.Request) {
+	evs, err := a.Judge.GetFulfillments(r.URL.Query().Get("ChannelId"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	// Each envelope is prefixed with its length.
+	b := []byte{}
+	for _, ev := range evs {
+		eb, err := proto.Marshal(ev)
+		if err != nil {
+			a.fail(w, errs.New(errs.Internal, "server error"))
+			return
+		}
+		b = append(b, proto.EncodeVarint(uint64(len(eb)))...)
+		b = append(b, eb...)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (a *HTTP) readEnvelope(w http.ResponseWriter, r *http.Request) (*wire.Envelope, error) {
+	if r.Body == nil {
+		return nil, errs.New(errs.BadRequest, "no body")
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, errs.New(errs.BadRequest, "body too large or unreadable")
+	}
+
+	ev := &wire.Envelope{}
+	err = proto.Unmarshal(b, ev)
+	if err != nil {
+		return nil, errs.New(errs.BadRequest, "body parsing error")
+	}
+
+	return ev, nil
+}
+
+// sendEnvelope writes a single protobuf envelope, or 404 if there is none.
+func (a *HTTP) sendEnvelope(w http.ResponseWriter, ev *wire.Envelope) {
+	if ev == nil {
+		a.fail(w, errs.New(errs.NotFound, "not found"))
+		return
+	}
+
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		a.fail(w, errs.New(errs.Internal, "server error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (a *HTTP) fail(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	code := errs.CodeOf(err)
+	data := struct {
+		Error string
+		Code  errs.Code
+	}{Error: err.Error(), Code: code}
+
+	resp, _ := json.Marshal(data)
+	w.WriteHeader(errs.Status(code))
+	w.Write(resp)
+}
+
+func (a *HTTP) send(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	resp, err := json.Marshal(data)
+	if err != nil {
+		a.fail(w, errs.New(errs.Internal, "oops something evil has happened"))
+		return
+	}
+	w.Write(resp)
+}
@@ -0,0 +1,171 @@
+package judge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestHTTP(t *testing.T) {
+	db, err := bolt.Open("/tmp/judge_http_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/judge_http_test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &Judge{DB: db}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	(&HTTP{Judge: jd}).MountRoutes(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	adminMux := http.NewServeMux()
+	(&HTTP{Judge: jd}).MountAdminRoutes(adminMux)
+	adminSrv := httptest.NewServer(adminMux)
+	defer adminSrv.Close()
+
+	cl := &clients.Judge{}
+
+	pub0, priv0, _ := ed25519.GenerateKey(rand.Reader)
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Nothing is served for a channel the judge does not know.
+
+	st, err := cl.GetStatus("xyz23", srv.URL)
+	if err != nil || st != nil {
+		t.Fatal("status of unknown channel", st, err)
+	}
+	ev, err := cl.GetOpeningTx("xyz23", srv.URL)
+	if err != nil || ev != nil {
+		t.Fatal("opening tx of unknown channel", ev, err)
+	}
+
+	resp, err := http.Post(srv.URL+"/add_channel", "application/octet-stream", bytes.NewReader(make([]byte, 2<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatal("oversized body was not refused", resp.StatusCode)
+	}
+
+	otx := &wire.OpeningTx{
+		ChannelId:  "xyz23",
+		Pubkeys:    [][]byte{pub0, pub1, jpub},
+		HoldPeriod: 10,
+	}
+
+	err = cl.AddChannel(signed(t, otx, priv0, priv1), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the operator can confirm a channel.
+
+	confirm := func(url string) int {
+		resp, err := http.Post(url+"/confirm_channel", "application/json", strings.NewReader(`{"ChannelId":"xyz23"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code := confirm(srv.URL)
+	if code != 404 {
+		t.Fatal("confirm_channel served to peers", code)
+	}
+	code = confirm(adminSrv.URL)
+	if code != 200 {
+		t.Fatal("confirm_channel failed", code)
+	}
+
+	ev, err = cl.GetOpeningTx("xyz23", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev == nil || len(ev.Signatures) != 3 || !ed25519.Verify(jpub, ev.Payload, ev.Signatures[2]) {
+		t.Fatal("opening tx not confirmed", ev)
+	}
+
+	st, err = cl.GetStatus("xyz23", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || st.ChannelId != "xyz23" || st.Phase != OPEN || !st.HoldPeriodStart.IsZero() {
+		t.Fatal("status of open channel", st)
+	}
+
+	ev, err = cl.GetUpdateTx("xyz23", srv.URL)
+	if err != nil || ev != nil {
+		t.Fatal("update tx before one was posted", ev, err)
+	}
+
+	utx := signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 2}, priv0, priv1)
+	err = cl.AddUpdateTx(utx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err = cl.GetUpdateTx("xyz23", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev == nil || string(ev.Payload) != string(utx.Payload) {
+		t.Fatal("update tx not served", ev)
+	}
+
+	st, err = cl.GetStatus("xyz23", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != PENDING_CLOSED || time.Since(st.HoldPeriodStart) > time.Minute {
+		t.Fatal("hold period not started", st)
+	}
+
+	err = cl.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 1}, priv0, priv1), srv.URL)
+	if errs.CodeOf(err) != errs.PeerRejected {
+		t.Fatal("lower sequence number not rejected", err)
+	}
+
+	fuls := []*wire.Envelope{
+		fulfillment("xyz23", []byte{80}, 0, priv0),
+		fulfillment("xyz23", []byte{81, 82}, 1, priv1),
+	}
+	for _, ful := range fuls {
+		err = cl.AddFulfillment("xyz23", ful, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evs, err := cl.GetFulfillments("xyz23", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 2 || string(evs[0].Payload) != string(fuls[0].Payload) || string(evs[1].Payload) != string(fuls[1].Payload) {
+		t.Fatal("fulfillments not served", evs)
+	}
+}
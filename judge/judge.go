@@ -0,0 +1,444 @@
+package judge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// Judge is a reference judge for development and integration tests. It follows
+// the judge's side of channel-lifecycle.md.
+type Judge struct {
+	DB *bolt.DB
+	// AutoConfirm makes the judge sign every valid OpeningTx as soon as it
+	// arrives, instead of waiting for ConfirmChannel.
+	AutoConfirm bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var _ clients.JudgeHandler = &Judge{}
+
+// Pubkey returns the judge's public key.
+func (a *Judge) Pubkey() ([]byte, error) {
+	var err error
+	priv := ed25519.PrivateKey{}
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		priv, err = GetKey(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.Public().(ed25519.PublicKey), nil
+}
+
+// AddChannel saves an OpeningTx signed by both participants, in the
+// PENDING_OPEN phase.
+func (a *Judge) AddChannel(ev *wire.Envelope) error {
+	var err error
+
+	otx := &wire.OpeningTx{}
+	err = proto.Unmarshal(ev.Payload, otx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		ch, err := GetChannel(tx, otx.ChannelId)
+		if err != nil {
+			return err
+		}
+		if ch != nil {
+			if bytes.Equal(ch.OpeningTxEnvelope.Payload, ev.Payload) {
+				// Resent, we already have it.
+				return nil
+			}
+			return errs.New(errs.AlreadyExists, "channel already exists")
+		}
+
+		priv, err := GetKey(tx)
+		if err != nil {
+			return err
+		}
+
+		err = checkOpeningTx(ev, otx, priv.Public().(ed25519.PublicKey))
+		if err != nil {
+			return err
+		}
+
+		ch = &Channel{
+			ChannelId:         otx.ChannelId,
+			Phase:             PENDING_OPEN,
+			OpeningTx:         otx,
+			OpeningTxEnvelope: ev,
+		}
+
+		if a.AutoConfirm {
+			confirm(ch, priv)
+		}
+
+		err = SetChannel(tx, ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConfirmChannel signs a channel's OpeningTx and starts serving it.
+func (a *Judge) ConfirmChannel(chID string) error {
+	var err error
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		ch, err := GetChannel(tx, chID)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return errs.New(errs.NotFound, "channel not found")
+		}
+
+		if ch.Phase != PENDING_OPEN {
+			return errs.New(errs.WrongPhase, "channel is not pending open")
+		}
+
+		priv, err := GetKey(tx)
+		if err != nil {
+			return err
+		}
+
+		confirm(ch, priv)
+
+		err = SetChannel(tx, ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddUpdateTx takes an UpdateTx signed by both participants. The first one
+// puts the channel into PENDING_CLOSED and starts the hold period. During the
+// hold period, an UpdateTx with a higher sequence number replaces the one on
+// file, without resetting the hold period. An UpdateTx marked Fast is a final
+// update for a cooperative close and closes the channel straight away, but like
+// any other it must be above every sequence number posted before it.
+//
+// UpdateTx 0 closes a channel that was never updated in the state it was
+// opened with. Both participants already signed that state in the OpeningTx,
+// so it only needs to be signed by the one closing the channel.
+func (a *Judge) AddUpdateTx(ev *wire.Envelope) error {
+	var err error
+
+	utx := &wire.UpdateTx{}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		ch, err := GetChannel(tx, utx.ChannelId)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return errs.New(errs.NotFound, "channel not found")
+		}
+
+		if ch.UpdateTxEnvelope != nil && bytes.Equal(ch.UpdateTxEnvelope.Payload, ev.Payload) {
+			// Resent, we already have it.
+			return nil
+		}
+
+		if utx.SequenceNumber == 0 {
+			if utx.Fast || !bytes.Equal(utx.State, ch.OpeningTx.State) {
+				return errs.New(errs.BadRequest, "update tx 0 must keep the opening state")
+			}
+			err = checkParticipantSignature(ev, ev.Payload, ch.OpeningTx.Pubkeys)
+			if err != nil {
+				return err
+			}
+		} else {
+			for i := 0; i < 2; i++ {
+				err = checkSignature(ev, i, ch.OpeningTx.Pubkeys[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		switch ch.Phase {
+		case OPEN:
+			ch.Phase = PENDING_CLOSED
+			ch.HoldPeriodStart = time.Now()
+		case PENDING_CLOSED:
+			if !time.Now().Before(ch.HoldPeriodEnd()) {
+				return errs.New(errs.WrongPhase, "hold period is over")
+			}
+			if utx.SequenceNumber <= ch.UpdateTx.SequenceNumber {
+				return errs.New(errs.StaleSequence, "sequence number too low")
+			}
+		default:
+			return errs.New(errs.WrongPhase, "channel is not open")
+		}
+
+		if utx.Fast {
+			// Both participants signed off on this being the final state, so
+			// there is nothing to wait for. Peers stop updating once they sign
+			// a close, since a close posted first would cut off any later
+			// update.
+			ch.Phase = CLOSED
+		}
+
+		ch.UpdateTx = utx
+		ch.UpdateTxEnvelope = ev
+
+		err = SetChannel(tx, ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddFulfillment stores a fulfillment signed by one of the participants over
+// clients.FulfillmentMessage. The channel must be in its hold period.
+func (a *Judge) AddFulfillment(chID string, ev *wire.Envelope) error {
+	var err error
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		ch, err := GetChannel(tx, chID)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return errs.New(errs.NotFound, "channel not found")
+		}
+
+		if ch.Phase != PENDING_CLOSED || !time.Now().Before(ch.HoldPeriodEnd()) {
+			return errs.New(errs.WrongPhase, "channel is not in its hold period")
+		}
+
+		for _, ful := range ch.Fulfillments {
+			if bytes.Equal(ful.Payload, ev.Payload) {
+				// Resent, we already have it.
+				return nil
+			}
+		}
+
+		err = checkParticipantSignature(ev, clients.FulfillmentMessage(chID, ev.Payload), ch.OpeningTx.Pubkeys)
+		if err != nil {
+			return err
+		}
+
+		ch.Fulfillments = append(ch.Fulfillments, ev)
+
+		err = SetChannel(tx, ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CloseExpired puts every channel whose hold period has run out into CLOSED.
+func (a *Judge) CloseExpired(now time.Time) error {
+	var err error
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		chs, err := GetChannels(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, ch := range chs {
+			if ch.Phase != PENDING_CLOSED || now.Before(ch.HoldPeriodEnd()) {
+				continue
+			}
+
+			ch.Phase = CLOSED
+
+			err = SetChannel(tx, ch)
+			if err != nil {
+				return errors.New("database error")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Start closes expired channels in the background, checking every tick.
+func (a *Judge) Start(tick time.Duration) {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			err := a.CloseExpired(time.Now())
+			if err != nil {
+				log.Println("judge:", err)
+			}
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops closing expired channels.
+func (a *Judge) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// GetOpeningTx returns the fully signed OpeningTx of an open channel, or nil
+// if the judge has not confirmed the channel.
+func (a *Judge) GetOpeningTx(chID string) (*wire.Envelope, error) {
+	ch, err := a.getChannel(chID)
+	if err != nil || ch == nil || ch.Phase == PENDING_OPEN {
+		return nil, err
+	}
+	return ch.OpeningTxEnvelope, nil
+}
+
+// GetUpdateTx returns the UpdateTx on file, or nil if none has been posted.
+func (a *Judge) GetUpdateTx(chID string) (*wire.Envelope, error) {
+	ch, err := a.getChannel(chID)
+	if err != nil || ch == nil {
+		return nil, err
+	}
+	return ch.UpdateTxEnvelope, nil
+}
+
+func (a *Judge) GetStatus(chID string) (*clients.ChannelStatus, error) {
+	ch, err := a.getChannel(chID)
+	if err != nil || ch == nil {
+		return nil, err
+	}
+	return &clients.ChannelStatus{
+		ChannelId:       ch.ChannelId,
+		Phase:           ch.Phase,
+		HoldPeriodStart: ch.HoldPeriodStart,
+	}, nil
+}
+
+func (a *Judge) GetFulfillments(chID string) ([]*wire.Envelope, error) {
+	ch, err := a.getChannel(chID)
+	if err != nil || ch == nil {
+		return nil, err
+	}
+	return ch.Fulfillments, nil
+}
+
+func (a *Judge) getChannel(chID string) (*Channel, error) {
+	var err error
+	ch := &Channel{}
+	err = a.DB.View(func(tx *bolt.Tx) error {
+		ch, err = GetChannel(tx, chID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// checkOpeningTx checks that the OpeningTx is signed by both participants, and
+// that if it names a judge, it is us.
+func checkOpeningTx(ev *wire.Envelope, otx *wire.OpeningTx, pubkey []byte) error {
+	if len(otx.Pubkeys) < 2 {
+		return errs.New(errs.BadRequest, "missing pubkeys")
+	}
+	if len(otx.Pubkeys) > 2 && !bytes.Equal(otx.Pubkeys[2], pubkey) {
+		return errs.New(errs.InvalidSignature, "wrong judge")
+	}
+	for i := 0; i < 2; i++ {
+		err := checkSignature(ev, i, otx.Pubkeys[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkParticipantSignature checks that the envelope is signed by at least one
+// of the two participants, and that each of their signatures on it is a valid
+// signature of msg.
+func checkParticipantSignature(ev *wire.Envelope, msg []byte, pubkeys [][]byte) error {
+	signed := false
+	for i := 0; i < 2; i++ {
+		if i < len(ev.Signatures) && len(ev.Signatures[i]) > 0 {
+			err := checkSignature(&wire.Envelope{Payload: msg, Signatures: ev.Signatures}, i, pubkeys[i])
+			if err != nil {
+				return err
+			}
+			signed = true
+		}
+	}
+	if !signed {
+		return errs.New(errs.InvalidSignature, "missing signature")
+	}
+	return nil
+}
+
+// confirm adds the judge's signature to the OpeningTx and opens the channel.
+func confirm(ch *Channel, priv ed25519.PrivateKey) {
+	ch.OpeningTxEnvelope.Signatures = append(ch.OpeningTxEnvelope.Signatures[:2], ed25519.Sign(priv, ch.OpeningTxEnvelope.Payload))
+	ch.Phase = OPEN
+}
+
+func checkSignature(ev *wire.Envelope, i int, pubkey []byte) error {
+	if i >= len(ev.Signatures) || len(ev.Signatures[i]) == 0 {
+		return errs.New(errs.InvalidSignature, "missing signature")
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errs.New(errs.InvalidSignature, "invalid pubkey")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubkey), ev.Payload, ev.Signatures[i]) {
+		return errs.New(errs.InvalidSignature, "invalid signature")
+	}
+	return nil
+}
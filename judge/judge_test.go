@@ -0,0 +1,295 @@
+package judge
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func signed(t *testing.T, msg proto.Message, privs ...ed25519.PrivateKey) *wire.Envelope {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &wire.Envelope{Payload: b}
+	for _, priv := range privs {
+		ev.Signatures = append(ev.Signatures, ed25519.Sign(priv, b))
+	}
+	return ev
+}
+
+// fulfillment makes an envelope carrying payload, signed by priv at index i the
+// way a participant submits a fulfillment.
+func fulfillment(chID string, payload []byte, i int, priv ed25519.PrivateKey) *wire.Envelope {
+	ev := &wire.Envelope{Payload: payload, Signatures: make([][]byte, i+1)}
+	ev.Signatures[i] = ed25519.Sign(priv, clients.FulfillmentMessage(chID, payload))
+	return ev
+}
+
+func TestLifecycle(t *testing.T) {
+	db, err := bolt.Open("/tmp/judge_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/judge_test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &Judge{DB: db, AutoConfirm: true}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub0, priv0, _ := ed25519.GenerateKey(rand.Reader)
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+
+	otx := &wire.OpeningTx{
+		ChannelId:  "xyz23",
+		Pubkeys:    [][]byte{pub0, pub1, jpub},
+		HoldPeriod: 10,
+	}
+
+	err = jd.AddChannel(signed(t, otx, priv0))
+	if err == nil {
+		t.Fatal("accepted opening tx with one signature")
+	}
+
+	err = jd.AddChannel(signed(t, otx, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := jd.GetOpeningTx("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev == nil || len(ev.Signatures) != 3 || !ed25519.Verify(jpub, ev.Payload, ev.Signatures[2]) {
+		t.Fatal("opening tx not confirmed", ev)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 2}, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != PENDING_CLOSED || st.HoldPeriodStart.IsZero() {
+		t.Fatal("hold period not started", st)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 1}, priv0, priv1))
+	if err == nil {
+		t.Fatal("replaced update tx with lower sequence number")
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 3}, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st2, err := jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st2.HoldPeriodStart.Equal(st.HoldPeriodStart) {
+		t.Fatal("hold period was reset")
+	}
+
+	err = jd.AddFulfillment("xyz23", signed(t, &wire.UpdateTx{State: []byte{81}}, priv0))
+	if err == nil {
+		t.Fatal("accepted fulfillment signed over the bare payload")
+	}
+
+	err = jd.AddFulfillment("xyz23", fulfillment("abc45", []byte{81}, 0, priv0))
+	if err == nil {
+		t.Fatal("accepted fulfillment signed for another channel")
+	}
+
+	err = jd.AddFulfillment("xyz23", fulfillment("xyz23", []byte{80}, 0, priv0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evs, err := jd.GetFulfillments("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 {
+		t.Fatal("expected one fulfillment, got", len(evs))
+	}
+
+	err = jd.CloseExpired(time.Now().Add(11 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != CLOSED {
+		t.Fatal("channel not closed", st.Phase)
+	}
+}
+
+func TestFastClose(t *testing.T) {
+	db, err := bolt.Open("/tmp/judge_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/judge_test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &Judge{DB: db, AutoConfirm: true}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub0, priv0, _ := ed25519.GenerateKey(rand.Reader)
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+
+	otx := &wire.OpeningTx{
+		ChannelId:  "xyz23",
+		Pubkeys:    [][]byte{pub0, pub1, jpub},
+		HoldPeriod: 10,
+	}
+
+	err = jd.AddChannel(signed(t, otx, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 2}, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 3, Fast: true}, priv0))
+	if err == nil {
+		t.Fatal("accepted final update tx with one signature")
+	}
+
+	// A final update tx signed before the one posted does not close the
+	// channel, nor does one at the same sequence number.
+	for _, seq := range []uint32{1, 2} {
+		err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: seq, State: []byte{1}, Fast: true}, priv0, priv1))
+		if errs.CodeOf(err) != errs.StaleSequence {
+			t.Fatal("accepted final update tx at sequence number", seq, err)
+		}
+	}
+	st, err := jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != PENDING_CLOSED {
+		t.Fatal("stale final update tx closed the channel", st.Phase)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 3, Fast: true}, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != CLOSED {
+		t.Fatal("channel not closed", st.Phase)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 4}, priv0, priv1))
+	if err == nil {
+		t.Fatal("accepted update tx after the channel closed")
+	}
+}
+
+func TestCloseWithOpeningState(t *testing.T) {
+	db, err := bolt.Open("/tmp/judge_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/judge_test.db")
+
+	err = MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &Judge{DB: db, AutoConfirm: true}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub0, priv0, _ := ed25519.GenerateKey(rand.Reader)
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+
+	otx := &wire.OpeningTx{
+		ChannelId:  "xyz23",
+		Pubkeys:    [][]byte{pub0, pub1, jpub},
+		State:      []byte{70},
+		HoldPeriod: 10,
+	}
+
+	err = jd.AddChannel(signed(t, otx, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 0, State: []byte{71}}, priv0))
+	if err == nil {
+		t.Fatal("accepted update tx 0 that changes the opening state")
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 0, State: []byte{70}, Fast: true}, priv0))
+	if err == nil {
+		t.Fatal("accepted update tx 0 marked Fast")
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 0, State: []byte{70}}, priv0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := jd.GetStatus("xyz23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != PENDING_CLOSED {
+		t.Fatal("hold period not started", st.Phase)
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 1, State: []byte{72}}, priv0))
+	if err == nil {
+		t.Fatal("accepted update tx 1 with one signature")
+	}
+
+	err = jd.AddUpdateTx(signed(t, &wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 1, State: []byte{72}}, priv0, priv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,33 +1,47 @@
 package logic
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
+	"io"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
 	core "github.com/jtremback/usc-core/peer"
 	"github.com/jtremback/usc-core/wire"
 	"github.com/jtremback/usc-peer/access"
 	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
 )
 
 type Caller struct {
-	DB             *bolt.DB
-	CounterpartyCl *clients.Counterparty
-	JudgeCl        *clients.Judge
+	DB             access.Store
+	CounterpartyCl clients.CounterpartyTransport
+	JudgeCl        clients.JudgeTransport
+	// ProposalTTL is how long a proposed channel may wait to be opened before
+	// it is abandoned. If it is zero, proposals never expire.
+	ProposalTTL time.Duration
+
+	keys keyring
 }
 
 func (a *Caller) ProposeChannel(state []byte, mpk []byte, tpk []byte, hold uint32) error {
 	var err error
 	cpt := &core.Counterparty{}
 	acct := &core.Account{}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		acct, err = access.GetAccount(tx, mpk)
+	err = a.DB.Update(func(tx access.Tx) error {
+		acct, err = tx.GetAccount(mpk)
 		if err != nil {
 			return err
 		}
 
-		cpt, err = access.GetCounterparty(tx, tpk)
+		cpt, err = tx.GetCounterparty(tpk)
+		if err != nil {
+			return err
+		}
+
+		err = a.withPrivkey(acct)
 		if err != nil {
 			return err
 		}
@@ -47,12 +61,17 @@ func (a *Caller) ProposeChannel(state []byte, mpk []byte, tpk []byte, hold uint3
 			return errors.New("server error")
 		}
 
-		err = a.CounterpartyCl.Send(ev, cpt.Address)
+		err = enqueue(tx, "Counterparty", "AddChannel", cpt.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "OpeningTx", "Sent", "Proposed", "Counterparty", ev)
 		if err != nil {
 			return err
 		}
 
-		access.SetChannel(tx, ch)
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -69,15 +88,42 @@ func (a *Caller) ProposeChannel(state []byte, mpk []byte, tpk []byte, hold uint3
 func (a *Caller) ConfirmChannel(chID string) error {
 	var err error
 	ch := &core.Channel{}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		ch, err = access.GetChannel(tx, chID)
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase != core.PENDING_OPEN {
+			return errs.New(errs.WrongPhase, "channel is not pending open")
+		}
+
+		expired, err := a.expired(tx, ch, time.Now())
+		if err != nil {
+			return err
+		}
+		if expired {
+			return errs.New(errs.WrongPhase, "proposal has expired")
+		}
+
+		err = a.withPrivkey(ch.Account)
 		if err != nil {
 			return err
 		}
 
 		ch.OpeningTxEnvelope = ch.Account.SignEnvelope(ch.OpeningTxEnvelope)
 
-		access.SetChannel(tx, ch)
+		err = enqueue(tx, "Judge", "AddChannel", ch.Judge.Address, ch.ChannelId, ch.OpeningTxEnvelope)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "OpeningTx", "Sent", "Signed", "Judge", ch.OpeningTxEnvelope)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -88,36 +134,43 @@ func (a *Caller) ConfirmChannel(chID string) error {
 		return err
 	}
 
-	err = a.JudgeCl.Send(ch.OpeningTxEnvelope, ch.Judge.Address)
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
+// OpenChannel opens a channel with the OpeningTx served by the judge, which
+// must be our OpeningTx signed by both participants and the judge.
 func (a *Caller) OpenChannel(ev *wire.Envelope) error {
 	var err error
 
 	ch := &core.Channel{}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
+	err = a.DB.Update(func(tx access.Tx) error {
 		otx := &wire.OpeningTx{}
 		err = proto.Unmarshal(ev.Payload, otx)
+		if err != nil {
+			return errs.New(errs.BadRequest, "payload parsing error")
+		}
+
+		ch, err = tx.GetChannel(otx.ChannelId)
 		if err != nil {
 			return err
 		}
 
-		ch, err = access.GetChannel(tx, otx.ChannelId)
+		err = checkOpeningTx(ch, ev)
 		if err != nil {
 			return err
 		}
 
-		ch.Open(ev, otx)
+		err = ch.Open(ev, otx)
 		if err != nil {
 			return err
 		}
 
-		access.SetChannel(tx, ch)
+		err = record(tx, ch.ChannelId, "OpeningTx", "Received", "Confirmed", "Judge", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -131,31 +184,51 @@ func (a *Caller) OpenChannel(ev *wire.Envelope) error {
 	return nil
 }
 
-func (a *Caller) SendUpdateTx(state []byte, chID string, fast bool) error {
+// SendUpdateTx proposes a new state to the counterparty. There can only be one
+// proposal at a time: an UpdateTx that the counterparty has proposed to us must
+// be confirmed, rejected or countered first, and one that we proposed must be
+// confirmed or rejected by the counterparty. The proposal's sequence number is
+// above anything we have signed or rejected on the channel.
+func (a *Caller) SendUpdateTx(state []byte, chID string) error {
 	var err error
 	ch := &core.Channel{}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		ch, err = access.GetChannel(tx, chID)
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
 		if err != nil {
 			return err
 		}
 
-		utx, err := ch.NewUpdateTx(state, fast)
+		if ch.ProposedUpdateTxEnvelope != nil && !signed(ch.ProposedUpdateTxEnvelope, ch.Me) {
+			return errs.New(errs.WrongPhase, "counterparty has proposed an update tx, confirm, reject or counter it first")
+		}
+
+		// The counterparty may already have signed our proposal, so replacing
+		// it with another of the same sequence number would be equivocation.
+		if ch.ProposedUpdateTxEnvelope != nil {
+			return errs.New(errs.WrongPhase, "our proposed update tx is still waiting for the counterparty")
+		}
+
+		err = a.withPrivkey(ch.Account)
 		if err != nil {
-			return errors.New("server error")
+			return err
 		}
 
-		ev, err := ch.SignUpdateTx(utx)
+		ev, err := proposeUpdateTx(tx, ch, state, false)
 		if err != nil {
-			return errors.New("server error")
+			return err
 		}
 
-		err = a.CounterpartyCl.Send(ev, ch.Counterparty.Address)
+		err = enqueue(tx, "Counterparty", "AddUpdateTx", ch.Counterparty.Address, ch.ChannelId, ev)
 		if err != nil {
 			return err
 		}
 
-		access.SetChannel(tx, ch)
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Proposed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -171,18 +244,224 @@ func (a *Caller) SendUpdateTx(state []byte, chID string, fast bool) error {
 
 func (a *Caller) ConfirmUpdateTx(chID string) error {
 	var err error
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		ch, err := access.GetChannel(tx, chID)
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.ProposedUpdateTx != nil && ch.ProposedUpdateTx.Fast {
+			return errs.New(errs.BadRequest, "proposed update tx is a close, accept it instead")
+		}
+
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		ev, err := ch.ConfirmUpdateTx()
+		if err != nil {
+			return err
+		}
+
+		err = signSequence(tx, ch.ChannelId, ch.LastFullUpdateTx.SequenceNumber, false)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Counterparty", "AddFullUpdateTx", ch.Counterparty.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Signed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RejectUpdateTx declines the ProposedUpdateTx that the counterparty sent us.
+// The counterparty is sent the reason, and the channel stays at
+// LastFullUpdateTx.
+func (a *Caller) RejectUpdateTx(chID string, reason string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		// The rejection is signed by the outbox, but fail now if it can't be.
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		err = rejectUpdateTx(tx, ch, reason)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CounterUpdateTx declines the ProposedUpdateTx that the counterparty sent us,
+// and proposes an UpdateTx with a different state in its place. The counter
+// has a higher sequence number than the declined proposal.
+func (a *Caller) CounterUpdateTx(state []byte, chID string, reason string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		err = rejectUpdateTx(tx, ch, reason)
+		if err != nil {
+			return err
+		}
+
+		ev, err := proposeUpdateTx(tx, ch, state, false)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Counterparty", "AddUpdateTx", ch.Counterparty.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Proposed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rejectUpdateTx queues the rejection of the counterparty's ProposedUpdateTx
+// and clears it from the channel. The channel still has to be saved.
+func rejectUpdateTx(tx access.Tx, ch *core.Channel, reason string) error {
+	ev := ch.ProposedUpdateTxEnvelope
+	if ev == nil {
+		return errs.New(errs.NotFound, "no proposed update tx")
+	}
+
+	if signed(ev, ch.Me) {
+		return errs.New(errs.BadRequest, "update tx was proposed by us")
+	}
+
+	err := sendRejection(tx, ch, ev, reason)
+	if err != nil {
+		return err
+	}
+
+	err = refuseSequence(tx, ch.ChannelId, ch.ProposedUpdateTx.SequenceNumber)
+	if err != nil {
+		return err
+	}
+
+	ch.ProposedUpdateTx = nil
+	ch.ProposedUpdateTxEnvelope = nil
+
+	return nil
+}
+
+// sendRejection queues an UpdateTx envelope to be sent back to the
+// counterparty that proposed it, with the reason it was rejected.
+func sendRejection(tx access.Tx, ch *core.Channel, ev *wire.Envelope, reason string) error {
+	err := tx.AddOutboxMessage(&access.OutboxMessage{
+		Recipient: "Counterparty",
+		Method:    "RejectUpdateTx",
+		Address:   ch.Counterparty.Address,
+		ChannelId: ch.ChannelId,
+		Envelope:  ev,
+		Reason:    reason,
+	})
+	if err != nil {
+		return errors.New("database error")
+	}
+
+	return recordRejection(tx, ch.ChannelId, "UpdateTx", "Sent", reason, ev)
+}
+
+// CloseChannel posts LastFullUpdateTx to the judge, starting the hold period,
+// and puts the channel into PENDING_CLOSED. A channel that was never updated is
+// closed with UpdateTx 0, which keeps the state of the OpeningTx and only needs
+// our signature.
+func (a *Caller) CloseChannel(chID string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
 		if err != nil {
 			return err
 		}
 
-		_, err = ch.ConfirmUpdateTx()
+		if ch.Phase != core.OPEN && ch.Phase != core.PENDING_CLOSED {
+			return errs.New(errs.WrongPhase, "channel is not open")
+		}
+
+		ev := ch.LastFullUpdateTxEnvelope
+		if ev == nil {
+			ev, err = a.openingUpdateTx(ch)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = enqueue(tx, "Judge", "AddUpdateTx", ch.Judge.Address, ch.ChannelId, ev)
 		if err != nil {
 			return err
 		}
 
-		access.SetChannel(tx, ch)
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Posted", "Judge", ev)
+		if err != nil {
+			return err
+		}
+
+		ch.Phase = core.PENDING_CLOSED
+
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -196,16 +475,38 @@ func (a *Caller) ConfirmUpdateTx(chID string) error {
 	return nil
 }
 
+// openingUpdateTx makes UpdateTx 0 for a channel, keeping the state of the
+// OpeningTx, signed by us.
+func (a *Caller) openingUpdateTx(ch *core.Channel) (*wire.Envelope, error) {
+	err := a.withPrivkey(ch.Account)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := proto.Marshal(&wire.UpdateTx{
+		ChannelId:      ch.ChannelId,
+		SequenceNumber: 0,
+		State:          ch.OpeningTx.State,
+	})
+	if err != nil {
+		return nil, errors.New("server error")
+	}
+
+	ev := &wire.Envelope{Payload: b}
+	sign(ev, ch.Me, ch.Account)
+	return ev, nil
+}
+
 func (a *Caller) CheckFinalUpdateTx(ev *wire.Envelope) error {
 	var err error
 	utx := &wire.UpdateTx{}
 	err = proto.Unmarshal(ev.Payload, utx)
 	if err != nil {
-		return err
+		return errs.New(errs.BadRequest, "payload parsing error")
 	}
 
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		ch, err := access.GetChannel(tx, utx.ChannelId)
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(utx.ChannelId)
 		if err != nil {
 			return err
 		}
@@ -214,14 +515,127 @@ func (a *Caller) CheckFinalUpdateTx(ev *wire.Envelope) error {
 		if err != nil {
 			return err
 		}
+
+		if ev2 == nil && settled(ch, ev, utx) {
+			ch.Phase = core.CLOSED
+		}
+
+		// The daemon fetches the posted UpdateTx on every poll, only record it
+		// the first time.
+		known, err := posted(tx, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+		if !known {
+			err = record(tx, ch.ChannelId, "UpdateTx", "Received", "Posted", "Judge", ev)
+			if err != nil {
+				return err
+			}
+		}
+
 		if ev2 != nil {
-			err = a.JudgeCl.Send(ev2, ch.Judge.Address)
+			err = enqueue(tx, "Judge", "AddUpdateTx", ch.Judge.Address, ch.ChannelId, ev2)
+			if err != nil {
+				return err
+			}
+
+			err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Posted", "Judge", ev2)
 			if err != nil {
 				return err
 			}
 		}
 
-		access.SetChannel(tx, ch)
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = detectEquivocation(a.DB, ev, utx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a *Caller) GetChannel(chID string) (*core.Channel, error) {
+	var err error
+	ch := &core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (a *Caller) GetChannels() ([]*core.Channel, error) {
+	var err error
+	chs := []*core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		chs, err = tx.GetChannels()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chs, nil
+}
+
+// GetProposedChannels returns channels proposed to us that we have not yet
+// confirmed.
+func (a *Caller) GetProposedChannels() ([]*core.Channel, error) {
+	var err error
+	chs := []*core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		chs, err = tx.GetProposedChannels()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chs, nil
+}
+
+// GetProposedUpdateTxs returns channels with a ProposedUpdateTx that we have
+// not yet signed.
+func (a *Caller) GetProposedUpdateTxs() ([]*core.Channel, error) {
+	var err error
+	chs := []*core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		chs, err = tx.GetProposedUpdateTxs()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chs, nil
+}
+
+func (a *Caller) AddJudge(name string, pubkey []byte, address string) error {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errs.New(errs.BadRequest, "pubkey is not an ed25519 public key")
+	}
+
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		err = tx.SetJudge(&core.Judge{
+			Name:    name,
+			Pubkey:  pubkey,
+			Address: address,
+		})
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -235,14 +649,89 @@ func (a *Caller) CheckFinalUpdateTx(ev *wire.Envelope) error {
 	return nil
 }
 
-func (a *Caller) AddJudge() {
+// NewAccount generates a keypair for a new account that uses the judge with
+// pubkey jpk. The node must be unlocked, so that the private key can be
+// encrypted.
+func (a *Caller) NewAccount(name string, jpk []byte) (*core.Account, error) {
+	var err error
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("server error")
+	}
 
+	acct := &core.Account{
+		Name:    name,
+		Pubkey:  pub,
+		Privkey: priv,
+	}
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		acct.Judge, err = tx.GetJudge(jpk)
+		if err != nil {
+			return err
+		}
+
+		err = a.sealNewKey(tx, acct)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetAccount(acct)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return acct, nil
 }
 
-func (a *Caller) NewAccount() {
+func (a *Caller) AddCounterparty(name string, pubkey []byte, jpk []byte, address string) error {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errs.New(errs.BadRequest, "pubkey is not an ed25519 public key")
+	}
+
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		jd, err := tx.GetJudge(jpk)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetCounterparty(&core.Counterparty{
+			Name:    name,
+			Pubkey:  pubkey,
+			Address: address,
+			Judge:   jd,
+		})
+		if err != nil {
+			return errors.New("database error")
+		}
 
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (a *Caller) AddCounterparty() {
+// Backup writes a snapshot of the database to w without stopping the node.
+// Only stores that implement access.Backuper can be backed up.
+func (a *Caller) Backup(w io.Writer) (int64, error) {
+	b, ok := a.DB.(access.Backuper)
+	if !ok {
+		return 0, errs.New(errs.BadRequest, "store does not support backups")
+	}
 
+	n, err := b.Backup(w)
+	if err != nil {
+		return n, errors.New("database error")
+	}
+	return n, nil
 }
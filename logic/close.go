@@ -0,0 +1,224 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// ProposeClose proposes a cooperative close: a final UpdateTx, marked Fast,
+// that keeps the state of LastFullUpdateTx. If the counterparty accepts it, the
+// judge closes the channel as soon as it is posted, without a hold period.
+func (a *Caller) ProposeClose(chID string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase != core.OPEN {
+			return errs.New(errs.WrongPhase, "channel is not open")
+		}
+
+		if ch.ProposedUpdateTxEnvelope != nil && !signed(ch.ProposedUpdateTxEnvelope, ch.Me) {
+			return errs.New(errs.WrongPhase, "counterparty has proposed an update tx, confirm, reject or counter it first")
+		}
+
+		if ch.ProposedUpdateTxEnvelope != nil {
+			return errs.New(errs.WrongPhase, "our proposed update tx is still waiting for the counterparty")
+		}
+
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		ev, err := proposeUpdateTx(tx, ch, closingState(ch), true)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Counterparty", "ProposeClose", ch.Counterparty.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Proposed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AcceptClose signs the final UpdateTx that the counterparty proposed, posts it
+// to the judge and sends it back to the counterparty. The channel is
+// PENDING_CLOSED until the daemon sees it settled by the judge.
+func (a *Caller) AcceptClose(chID string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase != core.OPEN {
+			return errs.New(errs.WrongPhase, "channel is not open")
+		}
+
+		if ch.ProposedUpdateTxEnvelope == nil || signed(ch.ProposedUpdateTxEnvelope, ch.Me) {
+			return errs.New(errs.NotFound, "no close proposed")
+		}
+
+		if !ch.ProposedUpdateTx.Fast {
+			return errs.New(errs.BadRequest, "proposed update tx is not a close")
+		}
+
+		// The judge settles the close without a hold period, so it must not
+		// change anything we have agreed on.
+		if !bytes.Equal(ch.ProposedUpdateTx.State, closingState(ch)) {
+			return errs.New(errs.BadRequest, "proposed close changes the state")
+		}
+
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		ev, err := ch.ConfirmUpdateTx()
+		if err != nil {
+			return err
+		}
+
+		err = signSequence(tx, ch.ChannelId, ch.LastFullUpdateTx.SequenceNumber, true)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Counterparty", "AddFullUpdateTx", ch.Counterparty.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Signed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Judge", "AddUpdateTx", ch.Judge.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Sent", "Posted", "Judge", ev)
+		if err != nil {
+			return err
+		}
+
+		ch.Phase = core.PENDING_CLOSED
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ProposeClose saves a final UpdateTx that the counterparty proposed for a
+// cooperative close. It is handled like any other proposed UpdateTx, but must
+// be marked Fast. AcceptClose checks that it keeps the agreed state.
+func (a *Counterparty) ProposeClose(ev *wire.Envelope) error {
+	var err error
+
+	utx := &wire.UpdateTx{}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	if !utx.Fast {
+		return errs.New(errs.BadRequest, "update tx is not final")
+	}
+
+	return a.addUpdateTx(ev, utx)
+}
+
+// closingState is the state that a final UpdateTx must have: that of
+// LastFullUpdateTx, or of the OpeningTx if there has been no update.
+func closingState(ch *core.Channel) []byte {
+	if ch.LastFullUpdateTx == nil {
+		return ch.OpeningTx.State
+	}
+	return ch.LastFullUpdateTx.State
+}
+
+// SettleChannel places a channel into CLOSED once the judge has closed it, ev
+// being the UpdateTx that the judge closed it with.
+func (a *Caller) SettleChannel(chID string, ev *wire.Envelope) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase == core.CLOSED {
+			return nil
+		}
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Received", "Closed", "Judge", ev)
+		if err != nil {
+			return err
+		}
+
+		ch.Phase = core.CLOSED
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// settled checks whether an UpdateTx posted to the judge is a final UpdateTx
+// signed by both of us, which the judge closes the channel on straight away.
+func settled(ch *core.Channel, ev *wire.Envelope, utx *wire.UpdateTx) bool {
+	if !utx.Fast {
+		return false
+	}
+	if checkSignature(ev, ch.Me, ch.Account.Pubkey) != nil {
+		return false
+	}
+	return checkSignature(ev, 1-ch.Me, ch.Counterparty.Pubkey) == nil
+}
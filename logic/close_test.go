@@ -0,0 +1,295 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
+	"github.com/jtremback/usc-peer/judge"
+)
+
+// opened sets up two nodes with an open channel between them.
+func opened(t *testing.T) (*node, *node, *judge.Judge, string) {
+	a, b, jd, chID := proposal(t)
+
+	err := b.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = jd.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.daemon.pollDue(time.Now())
+	b.daemon.pollDue(time.Now())
+
+	return a, b, jd, chID
+}
+
+func TestCooperativeClose(t *testing.T) {
+	a, b, jd, chID := opened(t)
+
+	err := a.caller.SendUpdateTx([]byte("goodbye"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = b.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = a.caller.ProposeClose(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = a.caller.AcceptClose(chID)
+	if errs.CodeOf(err) != errs.NotFound {
+		t.Fatal("accepted our own close", err)
+	}
+
+	err = b.caller.ConfirmUpdateTx(chID)
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("confirmed a close as an ordinary update", err)
+	}
+
+	err = b.caller.AcceptClose(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	st, err := jd.GetStatus(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != judge.CLOSED {
+		t.Fatal("judge did not settle the close", st.Phase)
+	}
+
+	for _, n := range []*node{a, b} {
+		if n.phase(t, chID) != core.PENDING_CLOSED {
+			t.Fatal("channel not pending closed", n.phase(t, chID))
+		}
+	}
+
+	// Well short of the hold period.
+	a.daemon.pollDue(time.Now().Add(5 * time.Second))
+	b.daemon.pollDue(time.Now().Add(5 * time.Second))
+
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.Phase != core.CLOSED {
+			t.Fatal("channel not closed", ch.Phase)
+		}
+		if string(ch.LastFullUpdateTx.State) != "goodbye" || !ch.LastFullUpdateTx.Fast {
+			t.Fatal("wrong final update tx", ch.LastFullUpdateTx)
+		}
+	}
+
+	err = a.caller.ProposeClose(chID)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("proposed closing a closed channel", err)
+	}
+
+	noEvidence(t, chID, a, b)
+}
+
+func TestCloseChangingState(t *testing.T) {
+	a, b, jd, chID := opened(t)
+
+	// b proposes a final UpdateTx that hands itself a different state.
+	ch, err := b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.withPrivkey(ch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utx, err := ch.NewUpdateTx([]byte("all mine"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := ch.SignUpdateTx(utx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.cpt.AddUpdateTx(ev)
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("took a final update tx as an ordinary proposal", err)
+	}
+
+	err = a.cpt.ProposeClose(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.caller.AcceptClose(chID)
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("accepted a close that changes the state", err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	if a.phase(t, chID) != core.OPEN {
+		t.Fatal("channel not open", a.phase(t, chID))
+	}
+
+	st, err := jd.GetStatus(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Phase != judge.OPEN {
+		t.Fatal("close was posted", st.Phase)
+	}
+}
+
+func TestUnilateralClose(t *testing.T) {
+	a, b, jd, chID := opened(t)
+	now := time.Now()
+
+	err := a.caller.CloseChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(now)
+
+	b.daemon.pollDue(now.Add(5 * time.Second))
+	if b.phase(t, chID) != core.PENDING_CLOSED {
+		t.Fatal("channel not pending closed", b.phase(t, chID))
+	}
+
+	// Past the hold period.
+	later := now.Add(11 * time.Second)
+	err = jd.CloseExpired(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []*node{a, b} {
+		n.daemon.pollDue(later)
+		if n.phase(t, chID) != core.CLOSED {
+			t.Fatal("channel not closed after the hold period", n.phase(t, chID))
+		}
+
+		n.daemon.pollDue(later.Add(time.Minute))
+		if _, ok := n.daemon.nextPoll[chID]; ok {
+			t.Fatal("closed channel still polled")
+		}
+	}
+}
+
+func TestStaleClose(t *testing.T) {
+	a, b, jd, chID := opened(t)
+
+	err := a.caller.SendUpdateTx([]byte("agreed"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	err = b.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	// a proposes a close. b ignores it and counters with an update instead.
+
+	err = a.caller.ProposeClose(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = b.caller.CounterUpdateTx([]byte("later"), chID, "not yet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	// b still holds a's signed close, so a signs no update after it.
+
+	err = a.caller.SendUpdateTx([]byte("later"), chID)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("updated a channel after signing a close", err)
+	}
+
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ch.LastFullUpdateTx.State) != "agreed" {
+			t.Fatal("channel updated after a close was signed", ch.LastFullUpdateTx)
+		}
+	}
+
+	// b signs a's stale close and posts it. The judge closes the channel at
+	// once, but at the state that both still hold.
+
+	es, err := a.caller.GetHistory(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev *wire.Envelope
+	for _, e := range es {
+		if e.Direction == "Sent" && e.Event == "Proposed" && e.SequenceNumber == 2 {
+			ev = e.Envelope
+		}
+	}
+	if ev == nil {
+		t.Fatal("close not in history")
+	}
+
+	ch, err := b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.withPrivkey(ch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign(ev, ch.Me, ch.Account)
+
+	err = jd.AddUpdateTx(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.daemon.pollDue(time.Now().Add(5 * time.Second))
+
+	es, err = a.caller.GetHistory(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	for _, e := range es {
+		if e.Direction == "Received" && e.Event == "Posted" {
+			utx := &wire.UpdateTx{}
+			err = proto.Unmarshal(e.Envelope.Payload, utx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(utx.State) != "agreed" {
+				t.Fatal("closed at a lost state", string(utx.State))
+			}
+			closed = true
+		}
+	}
+	if !closed || a.phase(t, chID) != core.CLOSED {
+		t.Fatal("channel not closed", a.phase(t, chID))
+	}
+}
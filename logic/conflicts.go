@@ -0,0 +1,41 @@
+package logic
+
+import (
+	"fmt"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+)
+
+// When both participants propose an UpdateTx at about the same time, both
+// proposals have the same sequence number and each side receives the other's
+// while waiting on its own. Neither side can sign the other's proposal, having
+// already signed its own with that sequence number, so each rejects the
+// other's. Each side keeps its own proposal until the counterparty's signed
+// rejection of it arrives, finds the rejection in its history, with the
+// reason, and can then propose again above the conflicting sequence number.
+
+// conflicts checks whether an UpdateTx from the counterparty clashes with our
+// own proposal that is still waiting to be confirmed.
+func conflicts(ch *core.Channel, utx *wire.UpdateTx) bool {
+	return ch.ProposedUpdateTx != nil &&
+		signed(ch.ProposedUpdateTxEnvelope, ch.Me) &&
+		ch.ProposedUpdateTx.SequenceNumber == utx.SequenceNumber
+}
+
+func conflictReason(utx *wire.UpdateTx) string {
+	return fmt.Sprintf("conflict: both participants proposed sequence number %d, propose again", utx.SequenceNumber)
+}
+
+// rejectConflict rejects the counterparty's ev, which conflicts with our
+// ProposedUpdateTx. Our proposal stays until the counterparty rejects it.
+func rejectConflict(tx access.Tx, ch *core.Channel, ev *wire.Envelope, utx *wire.UpdateTx) error {
+	done, err := rejected(tx, ch.ChannelId, ev)
+	if err != nil || done {
+		// The conflicting proposal was resent.
+		return err
+	}
+
+	return sendRejection(tx, ch, ev, conflictReason(utx))
+}
@@ -0,0 +1,161 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestConflictingUpdateTxs(t *testing.T) {
+	a, b, jd, chID := proposal(t)
+
+	err := b.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = jd.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.daemon.pollDue(time.Now())
+	b.daemon.pollDue(time.Now())
+
+	// Both propose sequence number 1 before either hears from the other.
+
+	err = a.caller.SendUpdateTx([]byte("from a"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.SendUpdateTx([]byte("from b"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	// a has rejected b's proposal, but keeps its own until b rejects it.
+
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ProposedUpdateTx == nil || string(ch.ProposedUpdateTx.State) != "from a" {
+		t.Fatal("own proposal dropped before it was rejected", ch.ProposedUpdateTx)
+	}
+
+	a.outbox.deliverDue(time.Now())
+	b.outbox.deliverDue(time.Now())
+
+	// Each side rejects the other's proposal, and neither is left pending.
+
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.ProposedUpdateTx != nil || ch.LastFullUpdateTx != nil {
+			t.Fatal("conflicting proposal kept", ch.ProposedUpdateTx, ch.LastFullUpdateTx)
+		}
+
+		es, err := n.caller.GetHistory(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, e := range es {
+			if e.Direction == "Received" && e.Event == "Rejected" && strings.HasPrefix(e.Reason, "conflict") {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("not told of the conflict")
+		}
+	}
+
+	// Both propose again at once. Both move on to sequence number 2, and
+	// conflict again.
+
+	err = a.caller.SendUpdateTx([]byte("from a"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.SendUpdateTx([]byte("from b"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.ProposedUpdateTx.SequenceNumber != 2 {
+			t.Fatal("proposed again at sequence number", ch.ProposedUpdateTx.SequenceNumber)
+		}
+	}
+	b.outbox.deliverDue(time.Now())
+	a.outbox.deliverDue(time.Now())
+	b.outbox.deliverDue(time.Now())
+
+	// This time only b proposes again.
+
+	err = b.caller.SendUpdateTx([]byte("from b"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later proposal from a does not replace b's before a has answered it.
+
+	ch, err = a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.caller.withPrivkey(ch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utx := &wire.UpdateTx{ChannelId: chID, SequenceNumber: 4, State: []byte("from a")}
+	payload, _ := proto.Marshal(utx)
+	ev := &wire.Envelope{Payload: payload}
+	sign(ev, ch.Me, ch.Account)
+
+	err = b.cpt.AddUpdateTx(ev)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("proposal replaced our own", err)
+	}
+
+	b.outbox.deliverDue(time.Now())
+
+	err = a.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	ch, err = b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || ch.LastFullUpdateTx.SequenceNumber != 3 || string(ch.LastFullUpdateTx.State) != "from b" {
+		t.Fatal("new proposal not confirmed", ch.LastFullUpdateTx)
+	}
+
+	noEvidence(t, chID, a, b)
+
+	for _, n := range []*node{a, b} {
+		msgs := 0
+		n.caller.DB.View(func(tx access.Tx) error {
+			ms, err := tx.GetOutboxMessages()
+			msgs = len(ms)
+			return err
+		})
+		if msgs != 0 {
+			t.Fatal("undelivered messages", msgs)
+		}
+	}
+}
@@ -1,49 +1,76 @@
 package logic
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"errors"
+	"log"
 
-	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
 	core "github.com/jtremback/usc-core/peer"
 	"github.com/jtremback/usc-core/wire"
 	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
 )
 
 type Counterparty struct {
-	db *bolt.DB
+	DB access.Store
 }
 
+var _ clients.CounterpartyHandler = &Counterparty{}
+
 func (a *Counterparty) AddChannel(ev *wire.Envelope) error {
 	var err error
 
 	otx := &wire.OpeningTx{}
 	err = proto.Unmarshal(ev.Payload, otx)
 	if err != nil {
-		return err
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	if len(otx.Pubkeys) != 3 {
+		return errs.New(errs.BadRequest, "opening tx must have 3 pubkeys")
+	}
+	for _, pubkey := range otx.Pubkeys {
+		if len(pubkey) != ed25519.PublicKeySize {
+			return errs.New(errs.BadRequest, "pubkey is not an ed25519 public key")
+		}
 	}
 
 	acct := &core.Account{}
 	cpt := &core.Counterparty{}
-	err = a.db.Update(func(tx *bolt.Tx) error {
-		_, err = access.GetChannel(tx, otx.ChannelId)
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(otx.ChannelId)
+		if err == nil {
+			if bytes.Equal(ch.OpeningTxEnvelope.Payload, ev.Payload) {
+				// We already have this proposal, it was resent.
+				return nil
+			}
+			return errs.New(errs.AlreadyExists, "channel already exists")
+		}
+
+		cpt, err = tx.GetCounterparty(otx.Pubkeys[0])
 		if err != nil {
-			return errors.New("channel already exists")
+			return err
 		}
 
-		cpt, err = access.GetCounterparty(tx, otx.Pubkeys[0])
+		acct, err = tx.GetAccount(otx.Pubkeys[1])
 		if err != nil {
 			return err
 		}
 
-		acct, err = access.GetAccount(tx, otx.Pubkeys[1])
+		ch, err = core.NewChannel(ev, otx, acct, cpt)
 		if err != nil {
 			return err
 		}
 
-		ch, err := core.NewChannel(ev, otx, acct, cpt)
+		err = record(tx, ch.ChannelId, "OpeningTx", "Received", "Proposed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
 
-		access.SetChannel(tx, ch)
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
@@ -63,33 +90,292 @@ func (a *Counterparty) AddUpdateTx(ev *wire.Envelope) error {
 	utx := &wire.UpdateTx{}
 	err = proto.Unmarshal(ev.Payload, utx)
 	if err != nil {
-		return err
+		return errs.New(errs.BadRequest, "payload parsing error")
 	}
 
-	err = a.db.Update(func(tx *bolt.Tx) error {
-		ch, err := access.GetChannel(tx, utx.ChannelId)
+	if utx.Fast {
+		return errs.New(errs.BadRequest, "final update tx must be sent with propose_close")
+	}
+
+	return a.addUpdateTx(ev, utx)
+}
+
+// addUpdateTx saves an UpdateTx that the counterparty proposed, once it has
+// been parsed.
+func (a *Counterparty) addUpdateTx(ev *wire.Envelope, utx *wire.UpdateTx) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(utx.ChannelId)
 		if err != nil {
 			return err
 		}
 
+		if resent(ch.ProposedUpdateTxEnvelope, ev) || resent(ch.LastFullUpdateTxEnvelope, ev) {
+			return nil
+		}
+
+		// UpdateTx 0 is only for closing a channel in its opening state.
+		if utx.SequenceNumber == 0 || ch.LastFullUpdateTx != nil && utx.SequenceNumber <= ch.LastFullUpdateTx.SequenceNumber {
+			return errs.New(errs.StaleSequence, "sequence number too low")
+		}
+
 		err = ch.CheckUpdateTx(ev, utx)
 		if err != nil {
 			return err
 		}
 
+		if conflicts(ch, utx) {
+			return rejectConflict(tx, ch, ev, utx)
+		}
+
+		s, err := tx.GetSigning(ch.ChannelId)
+		if err != nil {
+			return err
+		}
+		if utx.SequenceNumber <= s.Sequence {
+			done, err := rejected(tx, ch.ChannelId, ev)
+			if err != nil || done {
+				// We rejected it already, it was resent.
+				return err
+			}
+			return errs.New(errs.StaleSequence, "an update tx with this sequence number or higher has already been signed or rejected")
+		}
+
+		if s.Closing && !utx.Fast {
+			return errClosing
+		}
+
+		// Our proposal is only cleared by the counterparty's signed rejection
+		// or confirmation of it. It can still confirm it, so ev does not
+		// replace it.
+		if ch.ProposedUpdateTx != nil && signed(ch.ProposedUpdateTxEnvelope, ch.Me) {
+			return errs.New(errs.WrongPhase, "our proposed update tx is still waiting, reject or confirm it first")
+		}
+
 		ch.ProposedUpdateTx = utx
 		ch.ProposedUpdateTxEnvelope = ev
 
-		access.SetChannel(tx, ch)
+		err = record(tx, ch.ChannelId, "UpdateTx", "Received", "Proposed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
 		if err != nil {
 			return errors.New("database error")
 		}
 
 		return nil
 	})
+
+	derr := detectEquivocation(a.DB, ev, utx)
+	if derr != nil {
+		log.Println("equivocation check:", derr)
+	}
+
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// AddFullUpdateTx saves an UpdateTx that the counterparty has confirmed. Both
+// signatures must be valid and the sequence number must be higher than that
+// of LastFullUpdateTx.
+func (a *Counterparty) AddFullUpdateTx(ev *wire.Envelope) error {
+	var err error
+
+	utx := &wire.UpdateTx{}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(utx.ChannelId)
+		if err != nil {
+			return err
+		}
+
+		if resent(ch.LastFullUpdateTxEnvelope, ev) {
+			return nil
+		}
+
+		err = checkSignature(ev, ch.Me, ch.Account.Pubkey)
+		if err != nil {
+			return err
+		}
+
+		err = checkSignature(ev, 1-ch.Me, ch.Counterparty.Pubkey)
+		if err != nil {
+			return err
+		}
+
+		if ch.LastFullUpdateTx != nil && utx.SequenceNumber <= ch.LastFullUpdateTx.SequenceNumber {
+			return errs.New(errs.StaleSequence, "sequence number too low")
+		}
+
+		ch.LastFullUpdateTx = utx
+		ch.LastFullUpdateTxEnvelope = ev
+
+		err = record(tx, ch.ChannelId, "UpdateTx", "Received", "Confirmed", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		if ch.ProposedUpdateTx != nil && ch.ProposedUpdateTx.SequenceNumber <= utx.SequenceNumber {
+			ch.ProposedUpdateTx = nil
+			ch.ProposedUpdateTxEnvelope = nil
+		}
+
+		if utx.Fast {
+			// The counterparty accepted our close and is posting it to the
+			// judge.
+			ch.Phase = core.PENDING_CLOSED
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+
+	derr := detectEquivocation(a.DB, ev, utx)
+	if derr != nil {
+		log.Println("equivocation check:", derr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RejectChannel closes a channel that we proposed and the counterparty has
+// declined. The notice carries the payload of the OpeningTx we sent, and must be
+// signed as a rejection by the counterparty.
+func (a *Counterparty) RejectChannel(ev *wire.Envelope) error {
+	var err error
+
+	otx := &wire.OpeningTx{}
+	err = proto.Unmarshal(ev.Payload, otx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(otx.ChannelId)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(ev.Payload, ch.OpeningTxEnvelope.Payload) {
+			return errs.New(errs.BadRequest, "opening tx does not match")
+		}
+
+		err = checkRejection(ev, "", 1-ch.Me, ch.Counterparty.Pubkey)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase == core.CLOSED {
+			// Already rejected, the notice was resent.
+			return nil
+		}
+
+		if ch.Phase != core.PENDING_OPEN {
+			return errs.New(errs.WrongPhase, "channel is not pending open")
+		}
+
+		ch.Phase = core.CLOSED
+
+		err = record(tx, ch.ChannelId, "OpeningTx", "Received", "Rejected", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RejectUpdateTx clears an UpdateTx that we proposed and the counterparty has
+// declined, and records the reason it gave. The notice carries the payload of
+// the UpdateTx we sent, and must be signed as a rejection, reason included, by
+// the counterparty.
+func (a *Counterparty) RejectUpdateTx(ev *wire.Envelope, reason string) error {
+	var err error
+
+	utx := &wire.UpdateTx{}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		return errs.New(errs.BadRequest, "payload parsing error")
+	}
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(utx.ChannelId)
+		if err != nil {
+			return err
+		}
+
+		err = checkRejection(ev, reason, 1-ch.Me, ch.Counterparty.Pubkey)
+		if err != nil {
+			return err
+		}
+
+		if !resent(ch.ProposedUpdateTxEnvelope, ev) {
+			done, err := rejected(tx, ch.ChannelId, ev)
+			if err != nil {
+				return err
+			}
+			if done {
+				// Already rejected, the notice was resent.
+				return nil
+			}
+			return errs.New(errs.NotFound, "update tx is not proposed")
+		}
+
+		err = checkSignature(ch.ProposedUpdateTxEnvelope, ch.Me, ch.Account.Pubkey)
+		if err != nil {
+			return errs.New(errs.BadRequest, "update tx was not proposed by us")
+		}
+
+		ch.ProposedUpdateTx = nil
+		ch.ProposedUpdateTxEnvelope = nil
+
+		err = recordRejection(tx, ch.ChannelId, "UpdateTx", "Received", reason, ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// resent checks whether ev is a copy of an envelope we already have.
+func resent(have *wire.Envelope, ev *wire.Envelope) bool {
+	return have != nil && bytes.Equal(have.Payload, ev.Payload)
+}
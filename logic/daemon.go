@@ -0,0 +1,160 @@
+package logic
+
+import (
+	"log"
+	"time"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+)
+
+// Daemon checks with the judge of every channel at least once per hold period.
+// When it finds a fully signed OpeningTx it opens the channel, and when it finds
+// a posted UpdateTx it makes sure the judge has our LastFullUpdateTx, until the
+// judge closes the channel at the end of the hold period. Proposed channels
+// that are never opened are abandoned after the caller's ProposalTTL.
+type Daemon struct {
+	Caller *Caller
+	// Tick is how often the daemon looks for channels that are due to be polled.
+	Tick time.Duration
+
+	nextPoll map[string]time.Time
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Start runs the daemon in the background. If the polling loop panics, it is
+// restarted after Tick.
+func (a *Daemon) Start() {
+	if a.Tick == 0 {
+		a.Tick = time.Second
+	}
+	a.nextPoll = map[string]time.Time{}
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+
+	go func() {
+		defer close(a.done)
+		for {
+			if a.supervise() {
+				return
+			}
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(a.Tick):
+			}
+		}
+	}()
+}
+
+// Stop stops the daemon and waits for the current poll to finish.
+func (a *Daemon) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// supervise runs the polling loop, recovering from panics. It returns true if
+// the daemon was stopped.
+func (a *Daemon) supervise() (stopped bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("daemon: restarting after panic:", r)
+		}
+	}()
+
+	ticker := time.NewTicker(a.Tick)
+	defer ticker.Stop()
+
+	for {
+		a.pollDue(time.Now())
+		select {
+		case <-a.stop:
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Daemon) pollDue(now time.Time) {
+	chs := []*core.Channel{}
+	err := a.Caller.DB.View(func(tx access.Tx) error {
+		for _, phase := range []int{int(core.PENDING_OPEN), int(core.OPEN), int(core.PENDING_CLOSED)} {
+			pchs, err := tx.GetChannelsByPhase(phase)
+			if err != nil {
+				return err
+			}
+			chs = append(chs, pchs...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("daemon:", err)
+		return
+	}
+
+	polled := map[string]bool{}
+	for _, ch := range chs {
+		polled[ch.ChannelId] = true
+		if now.Before(a.nextPoll[ch.ChannelId]) {
+			continue
+		}
+
+		err = a.poll(ch, now)
+		if err != nil {
+			log.Println("daemon:", ch.ChannelId, err)
+		}
+
+		a.nextPoll[ch.ChannelId] = now.Add(pollInterval(ch))
+	}
+
+	// Forget channels that have closed.
+	for chID := range a.nextPoll {
+		if !polled[chID] {
+			delete(a.nextPoll, chID)
+		}
+	}
+}
+
+func (a *Daemon) poll(ch *core.Channel, now time.Time) error {
+	if ch.Phase == core.PENDING_OPEN {
+		ev, err := a.Caller.JudgeCl.GetOpeningTx(ch.ChannelId, ch.Judge.Address)
+		if err != nil {
+			return err
+		}
+		if ev == nil || checkOpeningTx(ch, ev) != nil {
+			return a.Caller.ExpireChannel(ch.ChannelId, now)
+		}
+		return a.Caller.OpenChannel(ev)
+	}
+
+	ev, err := a.Caller.JudgeCl.GetUpdateTx(ch.ChannelId, ch.Judge.Address)
+	if err != nil {
+		return err
+	}
+	if ev == nil {
+		return nil
+	}
+	err = a.Caller.CheckFinalUpdateTx(ev)
+	if err != nil {
+		return err
+	}
+
+	st, err := a.Caller.JudgeCl.GetStatus(ch.ChannelId, ch.Judge.Address)
+	if err != nil {
+		return err
+	}
+	if st == nil || st.Phase != "CLOSED" {
+		return nil
+	}
+	return a.Caller.SettleChannel(ch.ChannelId, ev)
+}
+
+// pollInterval is half of the channel's hold period, so that a posted UpdateTx
+// is always noticed while there is still time to answer it.
+func pollInterval(ch *core.Channel) time.Duration {
+	if ch.OpeningTx == nil || ch.OpeningTx.HoldPeriod < 2 {
+		return time.Second
+	}
+	return time.Duration(ch.OpeningTx.HoldPeriod) * time.Second / 2
+}
@@ -0,0 +1,126 @@
+package logic
+
+import (
+	"bytes"
+	"log"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+)
+
+// A participant equivocates by signing two different UpdateTxs with the same
+// sequence number. An honest node never does this, whether or not the first
+// was rejected: a rejected proposal is still signed, and could still be
+// posted, so every proposal, counter and confirmation is above the highest
+// sequence number the node has signed or rejected.
+
+// detectEquivocation checks an UpdateTx that the counterparty signed against
+// the others in the channel's history. If they signed a different one with the
+// same sequence number, the evidence is saved and an alert is logged. It runs
+// in its own transaction, so that the evidence is kept even when ev itself is
+// refused.
+func detectEquivocation(db access.Store, ev *wire.Envelope, utx *wire.UpdateTx) error {
+	found := []*access.Evidence{}
+	err := db.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(utx.ChannelId)
+		if err != nil {
+			return err
+		}
+
+		signer := 1 - ch.Me
+		if checkSignature(ev, signer, ch.Counterparty.Pubkey) != nil || checkOpeningTx(ch, ch.OpeningTxEnvelope) != nil {
+			return nil
+		}
+
+		es, err := tx.GetHistory(ch.ChannelId)
+		if err != nil {
+			return err
+		}
+		have, err := tx.GetEvidence(ch.ChannelId)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range es {
+			other := e.Envelope
+			if e.Kind != "UpdateTx" || e.SequenceNumber != utx.SequenceNumber || other == nil || bytes.Equal(other.Payload, ev.Payload) {
+				continue
+			}
+			if checkSignature(other, signer, ch.Counterparty.Pubkey) != nil {
+				continue
+			}
+
+			evd := &access.Evidence{
+				ChannelId:         ch.ChannelId,
+				SequenceNumber:    utx.SequenceNumber,
+				Signer:            signer,
+				OpeningTxEnvelope: ch.OpeningTxEnvelope,
+				Envelopes:         []*wire.Envelope{other, ev},
+			}
+			if sameEvidence(have, evd) {
+				continue
+			}
+
+			err = equivocated(tx, ch, evd)
+			if err != nil {
+				return err
+			}
+			have = append(have, evd)
+			found = append(found, evd)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, evd := range found {
+		log.Printf("ALERT: counterparty equivocated on channel %s: signed two UpdateTxs with sequence number %d, evidence %d saved", evd.ChannelId, evd.SequenceNumber, evd.Id)
+	}
+
+	return nil
+}
+
+// equivocated saves the evidence and notes it in the channel's history.
+func equivocated(tx access.Tx, ch *core.Channel, evd *access.Evidence) error {
+	err := tx.AddEvidence(evd)
+	if err != nil {
+		return err
+	}
+
+	e := newHistoryEntry(ch.ChannelId, "UpdateTx", "Local", "Equivocated", "", evd.Envelopes[1])
+	e.Reason = "counterparty signed another UpdateTx with this sequence number"
+	return addHistoryEntry(tx, e)
+}
+
+func sameEvidence(have []*access.Evidence, evd *access.Evidence) bool {
+	for _, h := range have {
+		if h.Same(evd) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEvidence returns the evidence of equivocation found on a channel. Each
+// piece can be checked with Verify, without access to our database.
+func (a *Caller) GetEvidence(chID string) ([]*access.Evidence, error) {
+	var err error
+	es := []*access.Evidence{}
+	err = a.DB.View(func(tx access.Tx) error {
+		_, err = tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		es, err = tx.GetEvidence(chID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
@@ -0,0 +1,253 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestEquivocation(t *testing.T) {
+	a, b, jd, chID := proposal(t)
+
+	err := b.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+	err = jd.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.daemon.pollDue(time.Now())
+	b.daemon.pollDue(time.Now())
+
+	err = b.caller.SendUpdateTx([]byte("agreed"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+	err = a.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	// b signs another UpdateTx with the sequence number it already agreed to.
+
+	ch, err := b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.withPrivkey(ch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utx := &wire.UpdateTx{ChannelId: chID, SequenceNumber: 1, State: []byte("better for b")}
+	payload, _ := proto.Marshal(utx)
+	ev := &wire.Envelope{Payload: payload}
+	sign(ev, ch.Me, ch.Account)
+
+	err = a.cpt.AddUpdateTx(ev)
+	if errs.CodeOf(err) != errs.StaleSequence {
+		t.Fatal("expected stale sequence, got", err)
+	}
+
+	// Resending it does not add more evidence.
+	a.cpt.AddUpdateTx(ev)
+
+	es, err := a.caller.GetEvidence(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 {
+		t.Fatal("expected one piece of evidence, got", len(es))
+	}
+
+	// The exported evidence checks out on its own.
+
+	b2, err := json.Marshal(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := []*access.Evidence{}
+	err = json.Unmarshal(b2, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exported[0].Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported[0].Signer != 1 {
+		t.Fatal("wrong signer", exported[0].Signer)
+	}
+
+	exported[0].Envelopes[1].Signatures[1][0] ^= 1
+	if exported[0].Verify() == nil {
+		t.Fatal("evidence with a bad signature verified")
+	}
+
+	hist, err := a.caller.GetHistory(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range hist {
+		if e.Event == "Equivocated" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("equivocation not in history")
+	}
+
+	// b's own node holds no evidence against a.
+
+	es, err = b.caller.GetEvidence(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 0 {
+		t.Fatal("evidence against an honest counterparty", len(es))
+	}
+}
+
+// noEvidence fails the test if a node has found evidence of equivocation.
+func noEvidence(t *testing.T, chID string, ns ...*node) {
+	for _, n := range ns {
+		es, err := n.caller.GetEvidence(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 0 {
+			t.Fatal("evidence against an honest counterparty", es[0].SequenceNumber)
+		}
+	}
+}
+
+// noVerifiableEvidence fails the test if any two UpdateTxs with the same
+// sequence number in the nodes' histories make evidence that verifies against
+// either participant.
+func noVerifiableEvidence(t *testing.T, chID string, ns ...*node) {
+	ch, err := ns[0].caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evs := []*wire.Envelope{}
+	seqs := []uint32{}
+	for _, n := range ns {
+		es, err := n.caller.GetHistory(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range es {
+			if e.Kind == "UpdateTx" && e.Envelope != nil {
+				evs = append(evs, e.Envelope)
+				seqs = append(seqs, e.SequenceNumber)
+			}
+		}
+	}
+
+	for i := range evs {
+		for j := i + 1; j < len(evs); j++ {
+			if seqs[i] != seqs[j] {
+				continue
+			}
+			for signer := uint32(0); signer < 2; signer++ {
+				evd := &access.Evidence{
+					ChannelId:         chID,
+					SequenceNumber:    seqs[i],
+					Signer:            signer,
+					OpeningTxEnvelope: ch.OpeningTxEnvelope,
+					Envelopes:         []*wire.Envelope{evs[i], evs[j]},
+				}
+				if evd.Verify() == nil {
+					t.Fatal("evidence against participant", signer, "verifies at sequence number", seqs[i])
+				}
+			}
+		}
+	}
+}
+
+func TestRejectAndProposeAgain(t *testing.T) {
+	a, b, _, chID := opened(t)
+
+	// a proposes, b rejects and a proposes again.
+
+	err := a.caller.SendUpdateTx([]byte("one"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	err = b.caller.RejectUpdateTx(chID, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = a.caller.SendUpdateTx([]byte("one again"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	// b counters, a counters back, and b confirms.
+
+	err = b.caller.CounterUpdateTx([]byte("two"), chID, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+	err = a.caller.CounterUpdateTx([]byte("three"), chID, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	err = b.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	// Both propose at once, conflict, and a proposes again.
+
+	err = a.caller.SendUpdateTx([]byte("four from a"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.SendUpdateTx([]byte("four from b"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	b.outbox.deliverDue(time.Now())
+	a.outbox.deliverDue(time.Now())
+
+	err = a.caller.SendUpdateTx([]byte("five"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	err = b.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || string(ch.LastFullUpdateTx.State) != "five" {
+		t.Fatal("last update tx not confirmed", ch.LastFullUpdateTx)
+	}
+
+	noEvidence(t, chID, a, b)
+	noVerifiableEvidence(t, chID, a, b)
+}
@@ -0,0 +1,167 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// Fulfillment is a signed fulfillment we have stored on a channel, and whether
+// the judge has accepted it.
+type Fulfillment struct {
+	Envelope *wire.Envelope
+	Accepted bool
+}
+
+// SubmitFulfillment signs a fulfillment with the channel's account, stores it
+// on the channel and queues it to be sent to the judge. The channel must be in its hold
+// period. The signature is over clients.FulfillmentMessage, never the bare
+// fulfillment, so this can't be used to sign arbitrary txs with the channel key.
+func (a *Caller) SubmitFulfillment(chID string, ful []byte) error {
+	var err error
+	ch := &core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = a.checkHoldPeriod(ch)
+	if err != nil {
+		return err
+	}
+
+	err = a.withPrivkey(ch.Account)
+	if err != nil {
+		return err
+	}
+
+	ev := signFulfillment(ch.ChannelId, ful, ch.Me, ch.Account)
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Judge", "AddFulfillment", ch.Judge.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		evs, err := decodeFulfillments(ch)
+		if err != nil {
+			return err
+		}
+		for _, ev2 := range evs {
+			if bytes.Equal(ev2.Payload, ful) {
+				// Already stored, we are only resending it.
+				return nil
+			}
+		}
+
+		b, err := proto.Marshal(ev)
+		if err != nil {
+			return errors.New("server error")
+		}
+		ch.Fulfillments = append(ch.Fulfillments, b)
+
+		err = record(tx, ch.ChannelId, "Fulfillment", "Sent", "Signed", "Judge", ev)
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetFulfillments returns the fulfillments stored on a channel, marking the
+// ones that the judge has accepted.
+func (a *Caller) GetFulfillments(chID string) ([]*Fulfillment, error) {
+	var err error
+	ch := &core.Channel{}
+	err = a.DB.View(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	evs, err := decodeFulfillments(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	accepted, err := a.JudgeCl.GetFulfillments(chID, ch.Judge.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	fuls := []*Fulfillment{}
+	for _, ev := range evs {
+		ful := &Fulfillment{Envelope: ev}
+		for _, ev2 := range accepted {
+			if bytes.Equal(ev.Payload, ev2.Payload) {
+				ful.Accepted = true
+			}
+		}
+		fuls = append(fuls, ful)
+	}
+
+	return fuls, nil
+}
+
+// checkHoldPeriod checks with the judge that the channel's hold period has
+// started and has not yet run out.
+func (a *Caller) checkHoldPeriod(ch *core.Channel) error {
+	if ch.Phase != core.PENDING_CLOSED {
+		return errs.New(errs.WrongPhase, "channel is not pending closed")
+	}
+
+	st, err := a.JudgeCl.GetStatus(ch.ChannelId, ch.Judge.Address)
+	if err != nil {
+		return err
+	}
+	if st == nil || st.HoldPeriodStart.IsZero() {
+		return errs.New(errs.WrongPhase, "hold period has not started")
+	}
+
+	end := st.HoldPeriodStart.Add(time.Duration(ch.OpeningTx.HoldPeriod) * time.Second)
+	if !time.Now().Before(end) {
+		return errs.New(errs.WrongPhase, "hold period is over")
+	}
+
+	return nil
+}
+
+func decodeFulfillments(ch *core.Channel) ([]*wire.Envelope, error) {
+	evs := []*wire.Envelope{}
+	for _, b := range ch.Fulfillments {
+		ev := &wire.Envelope{}
+		err := proto.Unmarshal(b, ev)
+		if err != nil {
+			return nil, errors.New("database error")
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
@@ -0,0 +1,79 @@
+package logic
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestFulfillments(t *testing.T) {
+	a, _, _, chID := opened(t)
+
+	err := a.caller.SubmitFulfillment(chID, []byte("proof"))
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("submitted a fulfillment on an open channel", err)
+	}
+
+	err = a.caller.CloseChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = a.caller.SubmitFulfillment(chID, []byte("proof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fuls, err := a.caller.GetFulfillments(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fuls) != 1 || string(fuls[0].Envelope.Payload) != "proof" || fuls[0].Accepted {
+		t.Fatal("fulfillment not stored, or accepted before it was sent", fuls)
+	}
+
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := fuls[0].Envelope
+	pubkey := ch.OpeningTx.Pubkeys[ch.Me]
+	if checkSignature(ev, ch.Me, pubkey) == nil {
+		t.Fatal("fulfillment signed over the bare payload")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubkey), clients.FulfillmentMessage(chID, []byte("proof")), ev.Signatures[ch.Me]) {
+		t.Fatal("fulfillment not signed over the fulfillment message")
+	}
+
+	a.outbox.deliverDue(time.Now())
+
+	// Resending is harmless.
+	err = a.caller.SubmitFulfillment(chID, []byte("proof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	fuls, err = a.caller.GetFulfillments(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fuls) != 1 || !fuls[0].Accepted {
+		t.Fatal("fulfillment not accepted by the judge", fuls)
+	}
+
+	err = a.caller.checkHoldPeriod(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.OpeningTx.HoldPeriod = 0
+	err = a.caller.checkHoldPeriod(ch)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("hold period not over", err)
+	}
+}
@@ -0,0 +1,86 @@
+package logic
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+)
+
+// record adds an envelope to the channel's history, in the same transaction as
+// the change it belongs to. See access.HistoryEntry for the values of kind,
+// direction, event and peer.
+func record(tx access.Tx, chID string, kind string, direction string, event string, peer string, ev *wire.Envelope) error {
+	return addHistoryEntry(tx, newHistoryEntry(chID, kind, direction, event, peer, ev))
+}
+
+// recordRejection adds a rejected envelope to the channel's history, along
+// with the reason that was given.
+func recordRejection(tx access.Tx, chID string, kind string, direction string, reason string, ev *wire.Envelope) error {
+	e := newHistoryEntry(chID, kind, direction, "Rejected", "Counterparty", ev)
+	e.Reason = reason
+	return addHistoryEntry(tx, e)
+}
+
+func newHistoryEntry(chID string, kind string, direction string, event string, peer string, ev *wire.Envelope) *access.HistoryEntry {
+	e := &access.HistoryEntry{
+		ChannelId: chID,
+		Kind:      kind,
+		Direction: direction,
+		Event:     event,
+		Peer:      peer,
+		Envelope:  ev,
+	}
+
+	if kind == "UpdateTx" {
+		utx := &wire.UpdateTx{}
+		err := proto.Unmarshal(ev.Payload, utx)
+		if err == nil {
+			e.SequenceNumber = utx.SequenceNumber
+		}
+	}
+
+	return e
+}
+
+func addHistoryEntry(tx access.Tx, e *access.HistoryEntry) error {
+	err := tx.AddHistoryEntry(e)
+	if err != nil {
+		return errors.New("database error")
+	}
+	return nil
+}
+
+// posted checks whether the channel's history shows an envelope with the same
+// payload as already posted to the judge, by us or by the counterparty.
+func posted(tx access.Tx, chID string, ev *wire.Envelope) (bool, error) {
+	return tx.HasHistoryEvent(chID, "Posted", ev.Payload)
+}
+
+// rejected checks whether the channel's history shows that an envelope with
+// the same payload was already rejected.
+func rejected(tx access.Tx, chID string, ev *wire.Envelope) (bool, error) {
+	return tx.HasHistoryEvent(chID, "Rejected", ev.Payload)
+}
+
+// GetHistory returns every envelope that has been sent, received, signed or
+// rejected on a channel.
+func (a *Caller) GetHistory(chID string) ([]*access.HistoryEntry, error) {
+	var err error
+	es := []*access.HistoryEntry{}
+	err = a.DB.View(func(tx access.Tx) error {
+		_, err = tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		es, err = tx.GetHistory(chID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
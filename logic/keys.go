@@ -0,0 +1,351 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// keyring holds the decrypted account keys while the node is unlocked. They
+// are only ever in memory.
+type keyring struct {
+	mu       sync.Mutex
+	key      []byte
+	privkeys map[string][]byte
+}
+
+// errKeyParamsChanged means the key params were changed by someone else
+// between deriving a key from them and using it, so the key must be derived
+// again.
+var errKeyParamsChanged = errors.New("key params changed")
+
+// keyParams reads the key params, nil if no passphrase has been set.
+func (a *Caller) keyParams() (*access.KeyParams, error) {
+	var err error
+	var params *access.KeyParams
+	err = a.DB.View(func(tx access.Tx) error {
+		params, err = tx.GetKeyParams()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// sameKeyParams checks whether two reads of the key params found the same
+// params.
+func sameKeyParams(p1 *access.KeyParams, p2 *access.KeyParams) bool {
+	if p1 == nil || p2 == nil {
+		return p1 == p2
+	}
+	return bytes.Equal(p1.Salt, p2.Salt) && bytes.Equal(p1.Check, p2.Check)
+}
+
+// Unlock decrypts the account keys with the passphrase so that the node can
+// sign. The first time it is called, it sets the passphrase. Accounts saved
+// before keys were encrypted have their keys encrypted and removed from the
+// Accounts and Channels buckets.
+func (a *Caller) Unlock(passphrase []byte) error {
+	var err error
+	key := []byte{}
+	privkeys := map[string][]byte{}
+	for {
+		// scrypt is slow on purpose, so the key is derived before the
+		// transaction, which then checks that the params have not changed.
+		var stored, params *access.KeyParams
+		stored, err = a.keyParams()
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			params, key, err = access.NewKeyParams(passphrase)
+			if err != nil {
+				return errors.New("server error")
+			}
+		} else {
+			key, err = stored.DeriveKey(passphrase)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = a.DB.Update(func(tx access.Tx) error {
+			cur, err := tx.GetKeyParams()
+			if err != nil {
+				return err
+			}
+			if !sameKeyParams(cur, stored) {
+				return errKeyParamsChanged
+			}
+
+			if params != nil {
+				err = tx.SetKeyParams(params)
+				if err != nil {
+					return errors.New("database error")
+				}
+			}
+
+			eks, err := tx.GetEncryptedKeys()
+			if err != nil {
+				return err
+			}
+			for _, ek := range eks {
+				priv, err := ek.Open(key)
+				if err != nil {
+					return err
+				}
+				privkeys[string(ek.Pubkey)] = priv
+			}
+
+			return encryptPlaintextKeys(tx, key, privkeys)
+		})
+		if err != errKeyParamsChanged {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+	a.keys.key = key
+	a.keys.privkeys = privkeys
+
+	return nil
+}
+
+// PlaintextKeys checks whether any account keys are still stored in the clear,
+// as they were before keys were encrypted.
+func (a *Caller) PlaintextKeys() (bool, error) {
+	var err error
+	found := false
+	err = a.DB.View(func(tx access.Tx) error {
+		accts, err := tx.GetAccounts()
+		if err != nil {
+			return err
+		}
+		for _, acct := range accts {
+			if len(acct.Privkey) > 0 {
+				found = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
+// EncryptKeys encrypts any account keys still stored in the clear with the
+// passphrase, as Unlock does, but leaves the node locked. The old keys may
+// still be found in pages that the database has freed until it is compacted.
+func (a *Caller) EncryptKeys(passphrase []byte) error {
+	err := a.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	return nil
+}
+
+// encryptPlaintextKeys seals any private keys still stored in the clear, and
+// saves the accounts and channels again without them.
+func encryptPlaintextKeys(tx access.Tx, key []byte, privkeys map[string][]byte) error {
+	accts, err := tx.GetAccounts()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, acct := range accts {
+		if len(acct.Privkey) == 0 {
+			continue
+		}
+		found = true
+
+		ek, err := access.SealKey(key, acct.Pubkey, acct.Privkey)
+		if err != nil {
+			return errors.New("server error")
+		}
+		err = tx.SetEncryptedKey(ek)
+		if err != nil {
+			return errors.New("database error")
+		}
+		privkeys[string(acct.Pubkey)] = acct.Privkey
+
+		err = tx.SetAccount(acct)
+		if err != nil {
+			return errors.New("database error")
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	chs, err := tx.GetChannels()
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+	}
+
+	return nil
+}
+
+// Lock forgets the decrypted account keys. Nothing can be signed until the
+// node is unlocked again.
+func (a *Caller) Lock() {
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+
+	for _, priv := range a.keys.privkeys {
+		wipe(priv)
+	}
+	wipe(a.keys.key)
+	a.keys.key = nil
+	a.keys.privkeys = nil
+}
+
+// Locked checks whether the account keys are locked.
+func (a *Caller) Locked() bool {
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+	return a.keys.key == nil
+}
+
+// ChangePassphrase encrypts every account key again under a new passphrase.
+// If the node is unlocked, it stays unlocked.
+func (a *Caller) ChangePassphrase(old []byte, passphrase []byte) error {
+	var err error
+	key := []byte{}
+	for {
+		var stored, params *access.KeyParams
+		var oldKey []byte
+		stored, err = a.keyParams()
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return errs.New(errs.Locked, "no passphrase has been set, unlock to set one")
+		}
+
+		oldKey, err = stored.DeriveKey(old)
+		if err != nil {
+			return err
+		}
+		params, key, err = access.NewKeyParams(passphrase)
+		if err != nil {
+			return errors.New("server error")
+		}
+
+		err = a.DB.Update(func(tx access.Tx) error {
+			cur, err := tx.GetKeyParams()
+			if err != nil {
+				return err
+			}
+			if !sameKeyParams(cur, stored) {
+				return errKeyParamsChanged
+			}
+
+			err = tx.SetKeyParams(params)
+			if err != nil {
+				return errors.New("database error")
+			}
+
+			eks, err := tx.GetEncryptedKeys()
+			if err != nil {
+				return err
+			}
+			for _, ek := range eks {
+				priv, err := ek.Open(oldKey)
+				if err != nil {
+					return err
+				}
+				ek, err = access.SealKey(key, ek.Pubkey, priv)
+				if err != nil {
+					return errors.New("server error")
+				}
+				err = tx.SetEncryptedKey(ek)
+				if err != nil {
+					return errors.New("database error")
+				}
+			}
+
+			return nil
+		})
+		if err != errKeyParamsChanged {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+	if a.keys.key != nil {
+		a.keys.key = key
+	}
+
+	return nil
+}
+
+// sealNewKey encrypts and saves the key of a new account, and keeps it in the
+// keyring. The node must be unlocked.
+func (a *Caller) sealNewKey(tx access.Tx, acct *core.Account) error {
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+
+	if a.keys.key == nil {
+		return errs.New(errs.Locked, "account keys are locked")
+	}
+
+	ek, err := access.SealKey(a.keys.key, acct.Pubkey, acct.Privkey)
+	if err != nil {
+		return errors.New("server error")
+	}
+	err = tx.SetEncryptedKey(ek)
+	if err != nil {
+		return errors.New("database error")
+	}
+
+	a.keys.privkeys[string(acct.Pubkey)] = append([]byte{}, acct.Privkey...)
+	return nil
+}
+
+// withPrivkey fills in the account's private key from the keyring, so that it
+// can sign.
+func (a *Caller) withPrivkey(acct *core.Account) error {
+	a.keys.mu.Lock()
+	defer a.keys.mu.Unlock()
+
+	if a.keys.key == nil {
+		return errs.New(errs.Locked, "account keys are locked")
+	}
+
+	priv, ok := a.keys.privkeys[string(acct.Pubkey)]
+	if !ok {
+		return errs.New(errs.NotFound, "account key not found")
+	}
+
+	acct.Privkey = append([]byte{}, priv...)
+	return nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
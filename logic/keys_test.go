@@ -0,0 +1,177 @@
+package logic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestKeys(t *testing.T) {
+	db, err := bolt.Open("/tmp/test_keys.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/test_keys.db")
+	err = access.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Caller{DB: &access.Bolt{DB: db}}
+	err = a.AddJudge("judge", []byte{10, 10, 10}, "judge")
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("accepted a short judge pubkey", err)
+	}
+
+	jpub := bytes.Repeat([]byte{10}, ed25519.PublicKeySize)
+	err = a.AddJudge("judge", jpub, "judge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.AddCounterparty("them", []byte{20, 20}, jpub, "them")
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("accepted a short counterparty pubkey", err)
+	}
+
+	// An account saved before keys were encrypted
+
+	legacy := &core.Account{
+		Name:    "old",
+		Pubkey:  []byte{20, 20, 20},
+		Privkey: []byte{30, 30, 30},
+		Judge:   &core.Judge{Name: "judge", Pubkey: jpub},
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := json.Marshal(legacy)
+		return tx.Bucket([]byte("Accounts")).Put(legacy.Pubkey, b)
+	})
+
+	_, err = a.NewAccount("new", jpub)
+	if errs.CodeOf(err) != errs.Locked {
+		t.Fatal("expected locked, got", err)
+	}
+
+	err = a.Unlock([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		acct, err := access.GetAccount(tx, legacy.Pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acct.Privkey != nil {
+			t.Fatal("legacy private key left unencrypted")
+		}
+		if tx.Bucket([]byte("Keys")).Get(legacy.Pubkey) == nil {
+			t.Fatal("legacy private key not sealed")
+		}
+		return nil
+	})
+
+	acct, err := a.NewAccount("new", jpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Lock()
+	if !a.Locked() {
+		t.Fatal("not locked")
+	}
+	err = a.withPrivkey(acct)
+	if errs.CodeOf(err) != errs.Locked {
+		t.Fatal("expected locked, got", err)
+	}
+
+	err = a.Unlock([]byte("hunter3"))
+	if errs.CodeOf(err) != errs.WrongPassphrase {
+		t.Fatal("expected wrong passphrase, got", err)
+	}
+
+	err = a.ChangePassphrase([]byte("hunter2"), []byte("hunter3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Locked() {
+		t.Fatal("changing passphrase unlocked the node")
+	}
+
+	err = a.Unlock([]byte("hunter2"))
+	if errs.CodeOf(err) != errs.WrongPassphrase {
+		t.Fatal("old passphrase still works", err)
+	}
+
+	err = a.Unlock([]byte("hunter3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []*core.Account{acct, legacy} {
+		signer := &core.Account{Pubkey: want.Pubkey}
+		err = a.withPrivkey(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(signer.Privkey, want.Privkey) {
+			t.Fatal("wrong private key for", want.Name)
+		}
+	}
+}
+
+// racingStore sets new key params at the start of the first Update, as if
+// another call had changed the passphrase while the key was being derived.
+type racingStore struct {
+	access.Store
+	params *access.KeyParams
+}
+
+func (a *racingStore) Update(fn func(tx access.Tx) error) error {
+	if a.params != nil {
+		params := a.params
+		a.params = nil
+		err := a.Store.Update(func(tx access.Tx) error {
+			return tx.SetKeyParams(params)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return a.Store.Update(fn)
+}
+
+func TestUnlockRace(t *testing.T) {
+	store := access.NewMemory()
+	a := &Caller{DB: store}
+	err := a.Unlock([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, _, err := access.NewKeyParams([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key derived from the old params must not be used once they have
+	// changed.
+	b := &Caller{DB: &racingStore{Store: store, params: params}}
+	err = b.Unlock([]byte("old"))
+	if errs.CodeOf(err) != errs.WrongPassphrase {
+		t.Fatal("unlocked with a passphrase that was changed", err)
+	}
+
+	err = b.Unlock([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,339 @@
+package logic
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+	"github.com/jtremback/usc-peer/judge"
+)
+
+type node struct {
+	caller *Caller
+	cpt    *Counterparty
+	outbox *Outbox
+	daemon *Daemon
+}
+
+func newNode(db access.Store, cptCl clients.CounterpartyTransport, jdCl clients.JudgeTransport) *node {
+	caller := &Caller{
+		DB:             db,
+		CounterpartyCl: cptCl,
+		JudgeCl:        jdCl,
+	}
+
+	return &node{
+		caller: caller,
+		cpt:    &Counterparty{DB: db},
+		outbox: &Outbox{Caller: caller, MaxBackoff: time.Second},
+		daemon: &Daemon{Caller: caller, nextPoll: map[string]time.Time{}},
+	}
+}
+
+func (a *node) phase(t *testing.T, chID string) core.Phase {
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch.Phase
+}
+
+func TestLoopback(t *testing.T) {
+	adb, err := bolt.Open("/tmp/test_a.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adb.Close()
+	defer os.Remove("/tmp/test_a.db")
+
+	err = access.MakeBuckets(adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jdb, err := bolt.Open("/tmp/test_judge.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jdb.Close()
+	defer os.Remove("/tmp/test_judge.db")
+
+	err = judge.MakeBuckets(jdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &judge.Judge{DB: jdb, AutoConfirm: true}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cptCl := &clients.LoopbackCounterparty{Handlers: map[string]clients.CounterpartyHandler{}}
+	jdCl := &clients.LoopbackJudge{Handlers: map[string]clients.JudgeHandler{
+		"judge": jd,
+	}}
+
+	// a keeps its data in bolt, b in memory.
+	a := newNode(&access.Bolt{DB: adb}, cptCl, jdCl)
+	b := newNode(access.NewMemory(), cptCl, jdCl)
+
+	cptCl.Handlers["a"] = a.cpt
+	cptCl.Handlers["b"] = b.cpt
+
+	// Setup
+
+	for _, n := range []*node{a, b} {
+		err = n.caller.Unlock([]byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.caller.AddJudge("judge", jpub, "judge")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acctA, err := a.caller.NewAccount("a", jpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acctB, err := b.caller.NewAccount("b", jpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.caller.AddCounterparty("b", acctB.Pubkey, jpub, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.AddCounterparty("a", acctA.Pubkey, jpub, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening
+
+	err = a.caller.ProposeChannel([]byte("hello"), acctA.Pubkey, acctB.Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	chs, err := b.caller.GetProposedChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 1 {
+		t.Fatal("expected one proposed channel, got", len(chs))
+	}
+	chID := chs[0].ChannelId
+
+	err = b.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	a.daemon.pollDue(time.Now())
+	b.daemon.pollDue(time.Now())
+
+	if a.phase(t, chID) != core.OPEN || b.phase(t, chID) != core.OPEN {
+		t.Fatal("channel not open", a.phase(t, chID), b.phase(t, chID))
+	}
+
+	// Updating
+
+	err = a.caller.SendUpdateTx([]byte("goodbye"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	chs, err = b.caller.GetProposedUpdateTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 1 || chs[0].ChannelId != chID {
+		t.Fatal("expected one proposed update tx, got", len(chs))
+	}
+
+	err = b.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || string(ch.LastFullUpdateTx.State) != "goodbye" {
+		t.Fatal("update tx not confirmed", ch.LastFullUpdateTx)
+	}
+
+	// Rejecting and countering
+
+	err = a.caller.SendUpdateTx([]byte("too much"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = a.caller.RejectUpdateTx(chID, "not mine")
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("rejected our own update tx", err)
+	}
+
+	ch, err = a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.cpt.RejectUpdateTx(ch.ProposedUpdateTxEnvelope, "made up")
+	if errs.CodeOf(err) != errs.InvalidSignature {
+		t.Fatal("took an unsigned rejection", err)
+	}
+
+	bch, err := b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.withPrivkey(bch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice := signRejection(bch.ProposedUpdateTxEnvelope, "no thanks", bch.Me, bch.Account)
+	err = a.cpt.RejectUpdateTx(notice, "made up")
+	if errs.CodeOf(err) != errs.InvalidSignature {
+		t.Fatal("took a rejection with a changed reason", err)
+	}
+
+	err = b.caller.RejectUpdateTx(chID, "no thanks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	ch, err = a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ProposedUpdateTx != nil {
+		t.Fatal("rejected update tx not cleared")
+	}
+
+	err = b.caller.RejectUpdateTx(chID, "no thanks")
+	if errs.CodeOf(err) != errs.NotFound {
+		t.Fatal("rejected update tx twice", err)
+	}
+
+	err = a.caller.SendUpdateTx([]byte("still too much"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	err = b.caller.CounterUpdateTx([]byte("fair"), chID, "how about this")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = a.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	ch, err = b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || string(ch.LastFullUpdateTx.State) != "fair" {
+		t.Fatal("counter proposal not confirmed", ch.LastFullUpdateTx)
+	}
+
+	// Closing
+
+	err = a.caller.CloseChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	// b polled the channel when it opened, so it is next due half a hold
+	// period later.
+	b.daemon.pollDue(time.Now())
+	if b.phase(t, chID) != core.OPEN {
+		t.Fatal("channel polled before it was due")
+	}
+	b.daemon.pollDue(time.Now().Add(5 * time.Second))
+
+	if a.phase(t, chID) != core.PENDING_CLOSED || b.phase(t, chID) != core.PENDING_CLOSED {
+		t.Fatal("channel not pending closed", a.phase(t, chID), b.phase(t, chID))
+	}
+
+	noEvidence(t, chID, a, b)
+
+	// History
+
+	b.daemon.pollDue(time.Now().Add(10 * time.Second))
+
+	events := func(n *node) []string {
+		es, err := n.caller.GetHistory(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evs := []string{}
+		for _, e := range es {
+			ev := e.Direction + " " + e.Kind + " " + e.Event
+			if e.Reason != "" {
+				ev += " (" + e.Reason + ")"
+			}
+			evs = append(evs, ev)
+		}
+		return evs
+	}
+
+	want := map[*node][]string{
+		a: {
+			"Sent OpeningTx Proposed",
+			"Received OpeningTx Confirmed",
+			"Sent UpdateTx Proposed",
+			"Received UpdateTx Confirmed",
+			"Sent UpdateTx Proposed",
+			"Received UpdateTx Rejected (no thanks)",
+			"Sent UpdateTx Proposed",
+			"Received UpdateTx Rejected (how about this)",
+			"Received UpdateTx Proposed",
+			"Sent UpdateTx Signed",
+			"Sent UpdateTx Posted",
+		},
+		b: {
+			"Received OpeningTx Proposed",
+			"Sent OpeningTx Signed",
+			"Received OpeningTx Confirmed",
+			"Received UpdateTx Proposed",
+			"Sent UpdateTx Signed",
+			"Received UpdateTx Proposed",
+			"Sent UpdateTx Rejected (no thanks)",
+			"Received UpdateTx Proposed",
+			"Sent UpdateTx Rejected (how about this)",
+			"Sent UpdateTx Proposed",
+			"Received UpdateTx Confirmed",
+			"Received UpdateTx Posted",
+		},
+	}
+	for n, evs := range want {
+		have := events(n)
+		if strings.Join(have, ", ") != strings.Join(evs, ", ") {
+			t.Fatal("history incorrect", have)
+		}
+	}
+}
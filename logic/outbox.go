@@ -0,0 +1,250 @@
+package logic
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// Outbox delivers the envelopes that Caller queues in the Outbox bucket, using
+// Caller's clients. A message is only deleted once it has been delivered, so a
+// message may be sent more than once if we crash in between. Counterparties
+// and judges treat a repeated envelope as a success.
+//
+// A message that the peer rejects, or that still fails after MaxAttempts, is
+// marked dead and recorded in the channel's history as Undelivered. The
+// channel's later messages could then no longer arrive in order, so they are
+// given up on along with it. UpdateTxs posted to the judge are the exception:
+// they are what keeps a channel from being closed on a stale state, so they
+// are retried until the judge takes or rejects them, and are never dropped.
+type Outbox struct {
+	Caller *Caller
+	// Tick is how often the outbox looks for messages that are due.
+	Tick time.Duration
+	// MaxBackoff caps the time between attempts to deliver a message.
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times a message is tried before it is given up
+	// on. Start sets it to 50 if it is zero. If it is negative, messages are
+	// retried until they are delivered or rejected.
+	MaxAttempts int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// enqueue queues an envelope to be delivered once tx has been committed.
+func enqueue(tx access.Tx, recipient string, method string, address string, chID string, ev *wire.Envelope) error {
+	err := tx.AddOutboxMessage(&access.OutboxMessage{
+		Recipient: recipient,
+		Method:    method,
+		Address:   address,
+		ChannelId: chID,
+		Envelope:  ev,
+	})
+	if err != nil {
+		return errors.New("database error")
+	}
+	return nil
+}
+
+// Start runs the outbox in the background.
+func (a *Outbox) Start() {
+	if a.Tick == 0 {
+		a.Tick = 500 * time.Millisecond
+	}
+	if a.MaxBackoff == 0 {
+		a.MaxBackoff = 10 * time.Minute
+	}
+	if a.MaxAttempts == 0 {
+		a.MaxAttempts = 50
+	}
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.Tick)
+		defer ticker.Stop()
+		for {
+			a.deliverDue(time.Now())
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the outbox and waits for the current delivery pass to finish.
+func (a *Outbox) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+func (a *Outbox) deliverDue(now time.Time) {
+	msgs := []*access.OutboxMessage{}
+	err := a.Caller.DB.View(func(tx access.Tx) error {
+		var err error
+		msgs, err = tx.GetOutboxMessages()
+		return err
+	})
+	if err != nil {
+		log.Println("outbox:", err)
+		return
+	}
+
+	// Messages for a channel must arrive in order, so once one is held back
+	// the rest of that channel's messages wait for the next pass, and once one
+	// is given up on the rest are given up on too.
+	blocked := map[string]bool{}
+	dropped := map[string]bool{}
+
+	for _, msg := range msgs {
+		if msg.Dead {
+			continue
+		}
+
+		var sendErr error
+		if dropped[msg.ChannelId] && !mustDeliver(msg) {
+			sendErr = errors.New("an earlier message on the channel was undelivered")
+			msg.LastError = sendErr.Error()
+			msg.Dead = true
+		} else {
+			if blocked[msg.ChannelId] {
+				continue
+			}
+			if now.Before(msg.NextAttempt) {
+				blocked[msg.ChannelId] = true
+				continue
+			}
+
+			sendErr = a.deliver(msg)
+			if sendErr != nil {
+				msg.Attempts++
+				msg.LastError = sendErr.Error()
+				log.Println("outbox:", msg.Method, msg.ChannelId, sendErr)
+
+				if errs.CodeOf(sendErr) == errs.PeerRejected || (!mustDeliver(msg) && a.MaxAttempts > 0 && msg.Attempts >= a.MaxAttempts) {
+					msg.Dead = true
+				} else {
+					blocked[msg.ChannelId] = true
+					msg.NextAttempt = now.Add(a.backoff(msg.Attempts))
+				}
+			}
+		}
+		if msg.Dead {
+			dropped[msg.ChannelId] = true
+		}
+
+		err = a.Caller.DB.Update(func(tx access.Tx) error {
+			if sendErr == nil {
+				return tx.DeleteOutboxMessage(msg.Id)
+			}
+
+			if msg.Dead {
+				e := newHistoryEntry(msg.ChannelId, outboxKind(msg), "Sent", "Undelivered", msg.Recipient, msg.Envelope)
+				e.Reason = msg.LastError
+				err := addHistoryEntry(tx, e)
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.SetOutboxMessage(msg)
+		})
+		if err != nil {
+			log.Println("outbox:", err)
+			return
+		}
+	}
+}
+
+func (a *Outbox) deliver(msg *access.OutboxMessage) error {
+	switch msg.Recipient + "." + msg.Method {
+	case "Counterparty.AddChannel":
+		return a.Caller.CounterpartyCl.AddChannel(msg.Envelope, msg.Address)
+	case "Counterparty.RejectChannel":
+		ev, err := a.signRejection(msg)
+		if err != nil {
+			return err
+		}
+		return a.Caller.CounterpartyCl.RejectChannel(ev, msg.Address)
+	case "Counterparty.AddUpdateTx":
+		return a.Caller.CounterpartyCl.AddUpdateTx(msg.Envelope, msg.Address)
+	case "Counterparty.AddFullUpdateTx":
+		return a.Caller.CounterpartyCl.AddFullUpdateTx(msg.Envelope, msg.Address)
+	case "Counterparty.RejectUpdateTx":
+		ev, err := a.signRejection(msg)
+		if err != nil {
+			return err
+		}
+		return a.Caller.CounterpartyCl.RejectUpdateTx(ev, msg.Reason, msg.Address)
+	case "Counterparty.ProposeClose":
+		return a.Caller.CounterpartyCl.ProposeClose(msg.Envelope, msg.Address)
+	case "Judge.AddChannel":
+		return a.Caller.JudgeCl.AddChannel(msg.Envelope, msg.Address)
+	case "Judge.AddUpdateTx":
+		return a.Caller.JudgeCl.AddUpdateTx(msg.Envelope, msg.Address)
+	case "Judge.AddFulfillment":
+		return a.Caller.JudgeCl.AddFulfillment(msg.ChannelId, msg.Envelope, msg.Address)
+	}
+	return errors.New("unknown outbox method " + msg.Recipient + "." + msg.Method)
+}
+
+// signRejection signs a queued rejection with the key of the channel's account.
+// Rejections are signed as they are sent rather than when they are queued,
+// since the counterparty handler that queues some of them holds no keys.
+func (a *Outbox) signRejection(msg *access.OutboxMessage) (*wire.Envelope, error) {
+	var err error
+	ch := &core.Channel{}
+	err = a.Caller.DB.View(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(msg.ChannelId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.Caller.withPrivkey(ch.Account)
+	if err != nil {
+		return nil, err
+	}
+
+	return signRejection(msg.Envelope, msg.Reason, ch.Me, ch.Account), nil
+}
+
+// mustDeliver reports whether a message is retried until it is delivered or
+// rejected, however long that takes.
+func mustDeliver(msg *access.OutboxMessage) bool {
+	return msg.Recipient == "Judge" && msg.Method == "AddUpdateTx"
+}
+
+// outboxKind is the kind of envelope that a message carries, as recorded in
+// history.
+func outboxKind(msg *access.OutboxMessage) string {
+	switch msg.Method {
+	case "AddChannel", "RejectChannel":
+		return "OpeningTx"
+	case "AddFulfillment":
+		return "Fulfillment"
+	}
+	return "UpdateTx"
+}
+
+// backoff doubles the wait after every failed attempt, up to MaxBackoff.
+func (a *Outbox) backoff(attempts int) time.Duration {
+	d := time.Second
+	for i := 1; i < attempts && d < a.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > a.MaxBackoff {
+		d = a.MaxBackoff
+	}
+	return d
+}
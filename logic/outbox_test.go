@@ -0,0 +1,205 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// failingCounterparty records the payloads it is sent, failing with the queued
+// errors first.
+type failingCounterparty struct {
+	errs []error
+	sent []string
+}
+
+func (a *failingCounterparty) send(ev *wire.Envelope) error {
+	if len(a.errs) > 0 {
+		err := a.errs[0]
+		a.errs = a.errs[1:]
+		return err
+	}
+	a.sent = append(a.sent, string(ev.Payload))
+	return nil
+}
+
+func (a *failingCounterparty) AddChannel(ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+func (a *failingCounterparty) RejectChannel(ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+func (a *failingCounterparty) AddUpdateTx(ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+func (a *failingCounterparty) AddFullUpdateTx(ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+func (a *failingCounterparty) RejectUpdateTx(ev *wire.Envelope, reason string, address string) error {
+	return a.send(ev)
+}
+func (a *failingCounterparty) ProposeClose(ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+
+// failingJudge shares its errors and record of sent payloads with a
+// failingCounterparty.
+type failingJudge struct {
+	*failingCounterparty
+}
+
+func (a *failingJudge) AddFulfillment(chID string, ev *wire.Envelope, address string) error {
+	return a.send(ev)
+}
+func (a *failingJudge) GetOpeningTx(chID string, address string) (*wire.Envelope, error) {
+	return nil, nil
+}
+func (a *failingJudge) GetUpdateTx(chID string, address string) (*wire.Envelope, error) {
+	return nil, nil
+}
+func (a *failingJudge) GetStatus(chID string, address string) (*clients.ChannelStatus, error) {
+	return nil, nil
+}
+func (a *failingJudge) GetFulfillments(chID string, address string) ([]*wire.Envelope, error) {
+	return nil, nil
+}
+
+func TestOutbox(t *testing.T) {
+	cpt := &failingCounterparty{}
+	caller := &Caller{DB: access.NewMemory(), CounterpartyCl: cpt, JudgeCl: &failingJudge{cpt}}
+	outbox := &Outbox{Caller: caller, MaxBackoff: 4 * time.Second}
+
+	queueTo := func(recipient string, chID string, payloads ...string) {
+		err := caller.DB.Update(func(tx access.Tx) error {
+			for _, p := range payloads {
+				err := enqueue(tx, recipient, "AddUpdateTx", "b", chID, &wire.Envelope{Payload: []byte(p)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue := func(chID string, payloads ...string) {
+		queueTo("Counterparty", chID, payloads...)
+	}
+
+	sent := func(want ...string) {
+		if len(cpt.sent) != len(want) {
+			t.Fatal("sent", cpt.sent, "expected", want)
+		}
+		for i := range want {
+			if cpt.sent[i] != want[i] {
+				t.Fatal("sent", cpt.sent, "expected", want)
+			}
+		}
+	}
+
+	// A failed message holds back the rest of its channel, but not others.
+
+	now := time.Now()
+	queue("x", "x1", "x2")
+	queue("y", "y1")
+	cpt.errs = []error{errs.New(errs.PeerUnreachable, "network error")}
+
+	outbox.deliverDue(now)
+	sent("y1")
+
+	outbox.deliverDue(now.Add(500 * time.Millisecond))
+	sent("y1")
+
+	outbox.deliverDue(now.Add(time.Second))
+	sent("y1", "x1", "x2")
+
+	// Backoff doubles up to MaxBackoff.
+
+	for i, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if outbox.backoff(i+1) != d {
+			t.Fatal("backoff after", i+1, "attempts is", outbox.backoff(i+1))
+		}
+	}
+
+	// A rejected message is given up on straight away, and so are the
+	// messages queued after it, except for posts to the judge.
+
+	queue("x", "x3", "x4")
+	queueTo("Judge", "x", "x5")
+	queue("x", "x6")
+	cpt.errs = []error{errs.New(errs.PeerRejected, "counterparty error: WRONG_PHASE: hold period is over")}
+
+	outbox.deliverDue(now)
+	sent("y1", "x1", "x2", "x5")
+
+	outbox.deliverDue(now.Add(time.Hour))
+	sent("y1", "x1", "x2", "x5")
+
+	var es []*access.HistoryEntry
+	err := caller.DB.View(func(tx access.Tx) error {
+		var err error
+		es, err = tx.GetHistory("x")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 3 || string(es[0].Envelope.Payload) != "x3" || string(es[1].Envelope.Payload) != "x4" || string(es[2].Envelope.Payload) != "x6" {
+		t.Fatal("undelivered messages not recorded", es)
+	}
+	for _, e := range es {
+		if e.Event != "Undelivered" || e.Reason == "" {
+			t.Fatal("undelivered message not recorded", e)
+		}
+	}
+
+	// So is one that fails too many times.
+
+	outbox.MaxAttempts = 2
+	queue("y", "y2", "y3")
+	cpt.errs = []error{
+		errs.New(errs.PeerUnreachable, "network error"),
+		errs.New(errs.PeerUnreachable, "network error"),
+	}
+
+	outbox.deliverDue(now)
+	sent("y1", "x1", "x2", "x5")
+
+	outbox.deliverDue(now.Add(time.Hour))
+	sent("y1", "x1", "x2", "x5")
+
+	var msgs []*access.OutboxMessage
+	err = caller.DB.View(func(tx access.Tx) error {
+		msgs, err = tx.GetOutboxMessages()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 {
+		t.Fatal("expected the undelivered messages to be kept", msgs)
+	}
+	for _, msg := range msgs {
+		if !msg.Dead {
+			t.Fatal("expected the undelivered messages to be kept as dead", msg)
+		}
+	}
+
+	// A post to the judge is never given up on for failing too often.
+
+	queueTo("Judge", "z", "z1")
+	cpt.errs = []error{
+		errs.New(errs.PeerUnreachable, "network error"),
+		errs.New(errs.PeerUnreachable, "network error"),
+		errs.New(errs.PeerUnreachable, "network error"),
+	}
+	for i := 0; i < 4; i++ {
+		outbox.deliverDue(now.Add(time.Duration(i+2) * time.Hour))
+	}
+	sent("y1", "x1", "x2", "x5", "z1")
+}
@@ -0,0 +1,150 @@
+package logic
+
+import (
+	"errors"
+	"time"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// A proposed channel that is never confirmed is closed without having been
+// open, which PhaseName shows as ABANDONED. That happens when we decline a
+// channel proposed to us, when the counterparty declines one we proposed, or
+// when a proposal is older than the caller's ProposalTTL.
+
+// DeclineChannel abandons a channel that the counterparty proposed to us, and
+// sends the OpeningTx back to tell them, signed as a rejection with our account
+// key when it is delivered.
+func (a *Caller) DeclineChannel(chID string) error {
+	var err error
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase != core.PENDING_OPEN {
+			return errs.New(errs.WrongPhase, "channel is not pending open")
+		}
+
+		if ch.Me == 0 {
+			return errs.New(errs.BadRequest, "channel was proposed by us")
+		}
+
+		ev := ch.OpeningTxEnvelope
+		if signed(ev, ch.Me) {
+			return errs.New(errs.WrongPhase, "channel has already been confirmed")
+		}
+
+		// The decline is signed by the outbox, but fail now if it can't be.
+		err = a.withPrivkey(ch.Account)
+		if err != nil {
+			return err
+		}
+
+		err = enqueue(tx, "Counterparty", "RejectChannel", ch.Counterparty.Address, ch.ChannelId, ev)
+		if err != nil {
+			return err
+		}
+
+		err = record(tx, ch.ChannelId, "OpeningTx", "Sent", "Rejected", "Counterparty", ev)
+		if err != nil {
+			return err
+		}
+
+		ch.Phase = core.CLOSED
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ExpireChannel abandons a proposed channel once it is older than ProposalTTL.
+// A channel that the judge has heard of is left alone, since the judge may
+// still open it.
+func (a *Caller) ExpireChannel(chID string, now time.Time) error {
+	var err error
+	ch := &core.Channel{}
+	expired := false
+	err = a.DB.View(func(tx access.Tx) error {
+		ch, err = tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+		expired, err = a.expired(tx, ch, now)
+		return err
+	})
+	if err != nil || !expired {
+		return err
+	}
+
+	status, err := a.JudgeCl.GetStatus(ch.ChannelId, ch.Judge.Address)
+	if err != nil {
+		return err
+	}
+	if status != nil {
+		return nil
+	}
+
+	err = a.DB.Update(func(tx access.Tx) error {
+		ch, err := tx.GetChannel(chID)
+		if err != nil {
+			return err
+		}
+
+		if ch.Phase != core.PENDING_OPEN {
+			return nil
+		}
+
+		err = record(tx, ch.ChannelId, "OpeningTx", "Local", "Abandoned", "", ch.OpeningTxEnvelope)
+		if err != nil {
+			return err
+		}
+
+		ch.Phase = core.CLOSED
+
+		err = tx.SetChannel(ch)
+		if err != nil {
+			return errors.New("database error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// expired checks whether a channel is still pending open more than ProposalTTL
+// after it was proposed. Channels with no proposal in their history never
+// expire.
+func (a *Caller) expired(tx access.Tx, ch *core.Channel, now time.Time) (bool, error) {
+	if a.ProposalTTL == 0 || ch.Phase != core.PENDING_OPEN {
+		return false, nil
+	}
+
+	es, err := tx.GetHistory(ch.ChannelId)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range es {
+		if e.Kind == "OpeningTx" && e.Event == "Proposed" {
+			return now.After(e.Time.Add(a.ProposalTTL)), nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,225 @@
+package logic
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+	"github.com/jtremback/usc-peer/judge"
+)
+
+// proposal sets up two nodes in memory, and has a propose a channel to b.
+func proposal(t *testing.T) (*node, *node, *judge.Judge, string) {
+	jdb, err := bolt.Open("/tmp/test_judge.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		jdb.Close()
+		os.Remove("/tmp/test_judge.db")
+	})
+
+	err = judge.MakeBuckets(jdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &judge.Judge{DB: jdb}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cptCl := &clients.LoopbackCounterparty{Handlers: map[string]clients.CounterpartyHandler{}}
+	jdCl := &clients.LoopbackJudge{Handlers: map[string]clients.JudgeHandler{
+		"judge": jd,
+	}}
+
+	a := newNode(access.NewMemory(), cptCl, jdCl)
+	b := newNode(access.NewMemory(), cptCl, jdCl)
+	cptCl.Handlers["a"] = a.cpt
+	cptCl.Handlers["b"] = b.cpt
+
+	accts := []*core.Account{}
+	for i, n := range []*node{a, b} {
+		err = n.caller.Unlock([]byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.caller.AddJudge("judge", jpub, "judge")
+		if err != nil {
+			t.Fatal(err)
+		}
+		acct, err := n.caller.NewAccount(string("ab"[i]), jpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accts = append(accts, acct)
+	}
+
+	err = a.caller.AddCounterparty("b", accts[1].Pubkey, jpub, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.caller.AddCounterparty("a", accts[0].Pubkey, jpub, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.caller.ProposeChannel([]byte("hello"), accts[0].Pubkey, accts[1].Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	chs, err := b.caller.GetProposedChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 1 {
+		t.Fatal("expected one proposed channel, got", len(chs))
+	}
+
+	return a, b, jd, chs[0].ChannelId
+}
+
+func TestDeclineChannel(t *testing.T) {
+	a, b, _, chID := proposal(t)
+
+	err := a.caller.DeclineChannel(chID)
+	if errs.CodeOf(err) != errs.BadRequest {
+		t.Fatal("declined our own proposal", err)
+	}
+
+	// The decline is signed with b's account key.
+	b.caller.Lock()
+	err = b.caller.DeclineChannel(chID)
+	if errs.CodeOf(err) != errs.Locked {
+		t.Fatal("declined without a key to sign with", err)
+	}
+	err = b.caller.Unlock([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.caller.DeclineChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if access.PhaseName(ch) != "ABANDONED" {
+			t.Fatal("channel not abandoned", access.PhaseName(ch))
+		}
+	}
+
+	err = b.caller.ConfirmChannel(chID)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("confirmed a declined channel", err)
+	}
+
+	chs, err := b.caller.GetProposedChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 0 {
+		t.Fatal("declined channel still proposed")
+	}
+}
+
+func TestExpireChannel(t *testing.T) {
+	a, b, _, chID := proposal(t)
+
+	for _, n := range []*node{a, b} {
+		n.caller.ProposalTTL = time.Hour
+	}
+
+	a.daemon.pollDue(time.Now())
+	b.daemon.pollDue(time.Now())
+
+	for _, n := range []*node{a, b} {
+		if n.phase(t, chID) != core.PENDING_OPEN {
+			t.Fatal("channel expired early")
+		}
+	}
+
+	err := b.caller.ExpireChannel(chID, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.caller.ConfirmChannel(chID)
+	if errs.CodeOf(err) != errs.WrongPhase {
+		t.Fatal("confirmed an expired proposal", err)
+	}
+
+	a.daemon.pollDue(time.Now().Add(2 * time.Hour))
+
+	for _, n := range []*node{a, b} {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if access.PhaseName(ch) != "ABANDONED" {
+			t.Fatal("channel not abandoned", access.PhaseName(ch))
+		}
+	}
+
+	es, err := a.caller.GetHistory(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := es[len(es)-1]
+	if last.Direction != "Local" || last.Event != "Abandoned" {
+		t.Fatal("abandonment not recorded", last)
+	}
+}
+
+func TestOpenChannel(t *testing.T) {
+	a, b, jd, chID := proposal(t)
+
+	err := b.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = jd.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := jd.GetOpeningTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []*wire.Envelope{
+		{Payload: ev.Payload, Signatures: ev.Signatures[:2]},
+		{Payload: ev.Payload, Signatures: [][]byte{ev.Signatures[0], ev.Signatures[1], ev.Signatures[0]}},
+		{Payload: append(append([]byte{}, ev.Payload...), 0), Signatures: ev.Signatures},
+	} {
+		err = a.caller.OpenChannel(bad)
+		if err == nil {
+			t.Fatal("opened with a bad opening tx", bad)
+		}
+	}
+
+	err = a.caller.OpenChannel(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.phase(t, chID) != core.OPEN {
+		t.Fatal("channel not opened", a.phase(t, chID))
+	}
+}
@@ -0,0 +1,109 @@
+package logic
+
+import (
+	"errors"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// A sequence number is never signed twice. Once we have signed an UpdateTx,
+// the counterparty holds it even if we clear it from the channel, so signing
+// another with the same sequence number would be equivocation. The highest
+// sequence number we have signed or refused on a channel is kept in access, and
+// everything we sign must be above it.
+//
+// Once we have signed a final UpdateTx, the counterparty can post it and the
+// judge closes the channel at once, cutting off anything signed after it. So
+// from then on we sign nothing but another final UpdateTx with the same state,
+// even if the close was rejected. The channel can still be closed with
+// CloseChannel.
+
+var errClosing = errs.New(errs.WrongPhase, "a close has been signed, the channel can only be closed")
+
+// proposeUpdateTx makes and signs an UpdateTx for us to propose, with a
+// sequence number above LastFullUpdateTx and above anything we have signed or
+// refused.
+func proposeUpdateTx(tx access.Tx, ch *core.Channel, state []byte, fast bool) (*wire.Envelope, error) {
+	s, err := tx.GetSigning(ch.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Closing && !fast {
+		return nil, errClosing
+	}
+
+	utx, err := ch.NewUpdateTx(state, fast)
+	if err != nil {
+		return nil, errors.New("server error")
+	}
+
+	if utx.SequenceNumber <= s.Sequence {
+		utx.SequenceNumber = s.Sequence + 1
+	}
+
+	ev, err := ch.SignUpdateTx(utx)
+	if err != nil {
+		return nil, errors.New("server error")
+	}
+
+	s.Sequence = utx.SequenceNumber
+	s.Closing = s.Closing || fast
+	err = tx.SetSigning(s)
+	if err != nil {
+		return nil, errors.New("database error")
+	}
+
+	return ev, nil
+}
+
+// signSequence checks that we have not signed or refused anything at seq or
+// above, or signed a close, before we sign an UpdateTx with it, and records
+// that we have.
+func signSequence(tx access.Tx, chID string, seq uint32, fast bool) error {
+	s, err := tx.GetSigning(chID)
+	if err != nil {
+		return err
+	}
+
+	if s.Closing && !fast {
+		return errClosing
+	}
+
+	if seq <= s.Sequence {
+		return errs.New(errs.StaleSequence, "an update tx with this sequence number or higher has already been signed or rejected")
+	}
+
+	s.Sequence = seq
+	s.Closing = s.Closing || fast
+	err = tx.SetSigning(s)
+	if err != nil {
+		return errors.New("database error")
+	}
+
+	return nil
+}
+
+// refuseSequence records that we have refused an UpdateTx with seq, so that
+// we never sign another one with it.
+func refuseSequence(tx access.Tx, chID string, seq uint32) error {
+	s, err := tx.GetSigning(chID)
+	if err != nil {
+		return err
+	}
+
+	if seq <= s.Sequence {
+		return nil
+	}
+
+	s.Sequence = seq
+	err = tx.SetSigning(s)
+	if err != nil {
+		return errors.New("database error")
+	}
+
+	return nil
+}
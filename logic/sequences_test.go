@@ -0,0 +1,103 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+func TestSequencesNotReused(t *testing.T) {
+	a, b, _, chID := opened(t)
+
+	seq := func(n *node) uint32 {
+		ch, err := n.caller.GetChannel(chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.ProposedUpdateTx == nil {
+			t.Fatal("nothing proposed")
+		}
+		return ch.ProposedUpdateTx.SequenceNumber
+	}
+
+	// a proposes 1 and b rejects it. a's next proposal is 2, not 1 again.
+
+	err := a.caller.SendUpdateTx([]byte("one"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+	err = b.caller.RejectUpdateTx(chID, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outbox.deliverDue(time.Now())
+
+	err = a.caller.SendUpdateTx([]byte("two"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq(a) != 2 {
+		t.Fatal("re-proposal reused a sequence number", seq(a))
+	}
+	a.outbox.deliverDue(time.Now())
+
+	// b counters it with 3, not 2.
+
+	err = b.caller.CounterUpdateTx([]byte("three"), chID, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq(b) != 3 {
+		t.Fatal("counter reused a sequence number", seq(b))
+	}
+	b.outbox.deliverDue(time.Now())
+
+	// b will not take another proposal at a sequence number it rejected. a
+	// signing one is equivocation, even though b rejected the first.
+
+	ch, err := a.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.caller.withPrivkey(ch.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utx := &wire.UpdateTx{ChannelId: chID, SequenceNumber: 2, State: []byte("two again")}
+	payload, _ := proto.Marshal(utx)
+	ev := &wire.Envelope{Payload: payload}
+	sign(ev, ch.Me, ch.Account)
+
+	err = b.cpt.AddUpdateTx(ev)
+	if errs.CodeOf(err) != errs.StaleSequence {
+		t.Fatal("took a proposal at a rejected sequence number", err)
+	}
+
+	err = a.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.outbox.deliverDue(time.Now())
+
+	ch, err = b.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || ch.LastFullUpdateTx.SequenceNumber != 3 || string(ch.LastFullUpdateTx.State) != "three" {
+		t.Fatal("counter not confirmed", ch.LastFullUpdateTx)
+	}
+
+	noEvidence(t, chID, a)
+
+	es, err := b.caller.GetEvidence(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].SequenceNumber != 2 || es[0].Verify() != nil {
+		t.Fatal("expected evidence of the second proposal at 2", es)
+	}
+}
@@ -0,0 +1,98 @@
+package logic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/errs"
+)
+
+// checkSignature checks that the envelope carries a valid signature from pubkey
+// at index i.
+func checkSignature(ev *wire.Envelope, i uint32, pubkey []byte) error {
+	if int(i) >= len(ev.Signatures) || len(ev.Signatures[i]) == 0 {
+		return errs.New(errs.InvalidSignature, "missing signature")
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errs.New(errs.InvalidSignature, "invalid pubkey")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubkey), ev.Payload, ev.Signatures[i]) {
+		return errs.New(errs.InvalidSignature, "invalid signature")
+	}
+	return nil
+}
+
+// checkOpeningTx checks that ev is the channel's OpeningTx, byte for byte, and
+// that it carries valid signatures from both participants and the judge.
+func checkOpeningTx(ch *core.Channel, ev *wire.Envelope) error {
+	if ch.OpeningTxEnvelope == nil || !bytes.Equal(ev.Payload, ch.OpeningTxEnvelope.Payload) {
+		return errs.New(errs.BadRequest, "opening tx does not match the channel")
+	}
+	if len(ch.OpeningTx.Pubkeys) < 2 {
+		return errs.New(errs.BadRequest, "opening tx is missing pubkeys")
+	}
+
+	pubkeys := [][]byte{ch.OpeningTx.Pubkeys[0], ch.OpeningTx.Pubkeys[1], ch.Judge.Pubkey}
+	for i, pubkey := range pubkeys {
+		err := checkSignature(ev, uint32(i), pubkey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signed checks whether the envelope carries a signature at index i. It does not
+// check that the signature is valid.
+func signed(ev *wire.Envelope, i uint32) bool {
+	return ev != nil && int(i) < len(ev.Signatures) && len(ev.Signatures[i]) > 0
+}
+
+// sign puts a signature from acct at index i of the envelope, making room for
+// it if needed.
+func sign(ev *wire.Envelope, i uint32, acct *core.Account) {
+	for len(ev.Signatures) <= int(i) {
+		ev.Signatures = append(ev.Signatures, []byte{})
+	}
+	ev.Signatures[i] = ed25519.Sign(ed25519.PrivateKey(acct.Privkey), ev.Payload)
+}
+
+// signRejection makes a notice rejecting ev: an envelope with the same payload
+// and a signature from acct at index i over the payload and the reason.
+func signRejection(ev *wire.Envelope, reason string, i uint32, acct *core.Account) *wire.Envelope {
+	notice := &wire.Envelope{Payload: ev.Payload}
+	for len(notice.Signatures) <= int(i) {
+		notice.Signatures = append(notice.Signatures, []byte{})
+	}
+	notice.Signatures[i] = ed25519.Sign(ed25519.PrivateKey(acct.Privkey), clients.RejectionMessage(ev.Payload, reason))
+	return notice
+}
+
+// checkRejection checks that a rejection notice carries a valid signature from
+// pubkey at index i over its payload and the reason.
+func checkRejection(ev *wire.Envelope, reason string, i uint32, pubkey []byte) error {
+	if int(i) >= len(ev.Signatures) || len(ev.Signatures[i]) == 0 {
+		return errs.New(errs.InvalidSignature, "missing signature")
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return errs.New(errs.InvalidSignature, "invalid pubkey")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubkey), clients.RejectionMessage(ev.Payload, reason), ev.Signatures[i]) {
+		return errs.New(errs.InvalidSignature, "invalid signature")
+	}
+	return nil
+}
+
+// signFulfillment makes an envelope carrying the fulfillment ful, with a
+// signature from acct at index i over the fulfillment message for the channel.
+func signFulfillment(chID string, ful []byte, i uint32, acct *core.Account) *wire.Envelope {
+	ev := &wire.Envelope{Payload: ful}
+	for len(ev.Signatures) <= int(i) {
+		ev.Signatures = append(ev.Signatures, []byte{})
+	}
+	ev.Signatures[i] = ed25519.Sign(ed25519.PrivateKey(acct.Privkey), clients.FulfillmentMessage(chID, ful))
+	return ev
+}
@@ -1,36 +1,241 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-peer/access"
 	"github.com/jtremback/usc-peer/clients"
 	"github.com/jtremback/usc-peer/logic"
 	"github.com/jtremback/usc-peer/servers"
 )
 
 func main() {
-	db, err := bolt.Open("main.db", 0600, nil)
+	callerAddr := flag.String("caller", ":3000", "address for the caller API")
+	counterpartyAddr := flag.String("counterparty", ":3001", "address for counterparties to reach us on")
+	dryRun := flag.Bool("migrate-dry-run", false, "print the database migrations that would run, then exit")
+	memory := flag.Bool("memory", false, "keep everything in memory, losing it when the node stops")
+	proposalTTL := flag.Duration("proposal-ttl", 72*time.Hour, "how long a proposed channel may wait to be opened before it is abandoned, 0 to wait forever")
+	flag.Parse()
+
+	var store access.Store
+	if *memory {
+		store = access.NewMemory()
+	} else {
+		db, err := openDB("main.db", *dryRun)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *dryRun {
+			db.Close()
+			return
+		}
+		db, err = encryptKeys(db, os.Stdin)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		store = &access.Bolt{DB: db}
+	}
+
+	callerLog, callerMux, counterpartyMux := newNode(store, *proposalTTL)
+
+	outbox := &logic.Outbox{
+		Caller: callerLog,
+	}
+	outbox.Start()
+	defer outbox.Stop()
+
+	daemon := &logic.Daemon{
+		Caller: callerLog,
+	}
+	daemon.Start()
+	defer daemon.Stop()
+
+	srvs := []*http.Server{
+		{Addr: *callerAddr, Handler: callerMux},
+		{Addr: *counterpartyAddr, Handler: counterpartyMux},
+	}
+	lns := []net.Listener{}
+	for _, srv := range srvs {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			fmt.Println(err)
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return
+		}
+		lns = append(lns, ln)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	err := serve(srvs, lns, sig)
 	if err != nil {
 		fmt.Println(err)
 	}
-	defer db.Close()
-
-	counterpartyCl := &clients.Counterparty{}
-	judgeCl := &clients.Judge{}
+}
 
+// newNode sets up the caller and counterparty logic on the store, and returns
+// the caller logic along with the handlers for the caller API and the
+// counterparty API.
+func newNode(store access.Store, proposalTTL time.Duration) (*logic.Caller, http.Handler, http.Handler) {
 	callerLog := &logic.Caller{
-		DB:             db,
-		CounterpartyCl: counterpartyCl,
-		JudgeCl:        judgeCl,
+		DB:             store,
+		CounterpartyCl: &clients.Counterparty{},
+		JudgeCl:        &clients.Judge{},
+		ProposalTTL:    proposalTTL,
+	}
+
+	counterpartyLog := &logic.Counterparty{
+		DB: store,
 	}
 
 	callerMux := http.NewServeMux()
 	callerSrv := &servers.Caller{
 		Logic: callerLog,
 	}
-
 	callerSrv.MountRoutes(callerMux)
-	http.ListenAndServe(":3000", callerMux)
+
+	counterpartyMux := http.NewServeMux()
+	counterpartySrv := &servers.CounterpartyHTTP{
+		Logic: counterpartyLog,
+	}
+	counterpartySrv.MountRoutes(counterpartyMux)
+
+	return callerLog, callerMux, counterpartyMux
+}
+
+// serve serves each server on its listener until one of them fails or stop
+// receives a signal. It then shuts them all down together, so that we never
+// keep taking requests from peers while the caller API is gone, or the other
+// way around.
+func serve(srvs []*http.Server, lns []net.Listener, stop <-chan os.Signal) error {
+	errs := make(chan error, len(srvs))
+	for i, srv := range srvs {
+		go func(srv *http.Server, ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(srv, lns[i])
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-stop:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range srvs {
+		serr := srv.Shutdown(ctx)
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// openDB opens the database at path and brings it up to date, printing the
+// migrations that ran. With dryRun, it prints the migrations that would run
+// without writing anything, and the database must already exist. If another
+// process has the database open, it gives up after a second rather than
+// waiting for it.
+func openDB(path string, dryRun bool) (*bolt.DB, error) {
+	if dryRun {
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database in use, is the peer still running? %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		err = access.MakeBuckets(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	results, err := access.Migrate(db, dryRun)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, res := range results {
+		fmt.Printf("migration %d: %s\n", res.Version, res.Description)
+		for _, c := range res.Changes {
+			fmt.Println("  " + c)
+		}
+	}
+	if dryRun && len(results) == 0 {
+		fmt.Println("database is up to date")
+	}
+
+	return db, nil
+}
+
+// encryptKeys encrypts any account keys that an older version left in the
+// clear, asking for the passphrase on in, and then compacts main.db so that the
+// old keys are not left behind in freed pages. It returns main.db opened again.
+func encryptKeys(db *bolt.DB, in io.Reader) (*bolt.DB, error) {
+	caller := &logic.Caller{DB: &access.Bolt{DB: db}}
+	found, err := caller.PlaintextKeys()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !found {
+		return db, nil
+	}
+
+	fmt.Print("main.db has account keys that are not encrypted, enter the passphrase to encrypt them with: ")
+	passphrase, err := bufio.NewReader(in).ReadBytes('\n')
+	if err != nil && len(passphrase) == 0 {
+		db.Close()
+		return nil, err
+	}
+
+	err = caller.EncryptKeys(bytes.TrimRight(passphrase, "\r\n"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	path := db.Path()
+	err = db.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = access.Compact(path)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("account keys encrypted, and main.db compacted")
+
+	return bolt.Open(path, 0600, nil)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/logic"
+)
+
+func TestEncryptKeys(t *testing.T) {
+	path := "/tmp/test_main.db"
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	err = access.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An account saved before keys were encrypted
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	jd := &core.Judge{Name: "judge", Pubkey: bytes.Repeat([]byte{7}, 32), Address: "judge"}
+	legacy := &core.Account{Name: "old", Pubkey: pub, Privkey: priv, Judge: jd}
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := access.SetJudge(tx, jd)
+		if err != nil {
+			return err
+		}
+		b, _ := json.Marshal(legacy)
+		return tx.Bucket([]byte("Accounts")).Put(pub, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = encryptKeys(db, strings.NewReader("hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Keys")).Get(pub) == nil {
+			t.Fatal("private key not sealed")
+		}
+		return nil
+	})
+	db.Close()
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, priv) || bytes.Contains(raw, []byte(base64.StdEncoding.EncodeToString(priv))) {
+		t.Fatal("private key left in main.db")
+	}
+}
+
+func TestServe(t *testing.T) {
+	store := access.NewMemory()
+	callerLog, callerMux, counterpartyMux := newNode(store, 0)
+
+	srvs := []*http.Server{{Handler: callerMux}, {Handler: counterpartyMux}}
+	lns := []net.Listener{}
+	for range srvs {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+	}
+	callerURL := "http://" + lns[0].Addr().String()
+	counterpartyURL := "http://" + lns[1].Addr().String()
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(srvs, lns, stop)
+	}()
+
+	// A peer proposes a channel to us on the counterparty API.
+
+	jpub, _, _ := ed25519.GenerateKey(rand.Reader)
+	proposer := &logic.Caller{DB: access.NewMemory(), CounterpartyCl: &clients.Counterparty{}, JudgeCl: &clients.Judge{}}
+
+	accts := []*core.Account{}
+	for _, c := range []*logic.Caller{callerLog, proposer} {
+		err := c.Unlock([]byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.AddJudge("judge", jpub, "http://127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		acct, err := c.NewAccount("acct", jpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accts = append(accts, acct)
+	}
+	err := callerLog.AddCounterparty("proposer", accts[1].Pubkey, jpub, "http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proposer.AddCounterparty("us", accts[0].Pubkey, jpub, counterpartyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(counterpartyURL+"/add_channel", "application/octet-stream", strings.NewReader("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatal("add_channel did not refuse garbage", resp.StatusCode)
+	}
+
+	err = proposer.ProposeChannel([]byte("hello"), accts[1].Pubkey, accts[0].Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := &logic.Outbox{Caller: proposer}
+	outbox.Start()
+	outbox.Stop()
+
+	// It shows up on the caller API, which shares the store.
+
+	resp, err = http.Post(callerURL+"/get_proposed_channels", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chs := []json.RawMessage{}
+	err = json.NewDecoder(resp.Body).Decode(&chs)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 1 {
+		t.Fatal("proposed channel not received", len(chs))
+	}
+
+	// Both listeners shut down together.
+
+	stop <- os.Interrupt
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not return")
+	}
+
+	for _, url := range []string{callerURL, counterpartyURL} {
+		_, err = http.Post(url+"/add_channel", "application/octet-stream", strings.NewReader("garbage"))
+		if err == nil {
+			t.Fatal("still serving on", url)
+		}
+	}
+}
+
+func TestOpenDBDryRun(t *testing.T) {
+	path := "/tmp/test_main.db"
+	defer os.Remove(path)
+
+	_, err := openDB(path, true)
+	if err == nil {
+		t.Fatal("dry run created a database")
+	}
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Channels")) != nil {
+			t.Fatal("dry run made buckets")
+		}
+		return nil
+	})
+	db.Close()
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("dry run wrote to the database")
+	}
+
+	db, err = openDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = openDB(path, true)
+	if err == nil || !strings.Contains(err.Error(), "database in use") {
+		t.Fatal("dry run did not report the database in use", err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if access.SchemaVersion(tx) != access.LatestSchemaVersion() {
+			t.Fatal("database not migrated")
+		}
+		return nil
+	})
+}
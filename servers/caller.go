@@ -2,9 +2,14 @@ package servers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
 	"github.com/jtremback/usc-peer/logic"
+	"github.com/jtremback/usc-peer/views"
 )
 
 type Caller struct {
@@ -14,13 +19,35 @@ type Caller struct {
 func (a *Caller) MountRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/propose_channel", a.proposeChannel)
 	mux.HandleFunc("/confirm_channel", a.confirmChannel)
+	mux.HandleFunc("/decline_channel", a.declineChannel)
 	mux.HandleFunc("/send_update_tx", a.sendUpdateTx)
 	mux.HandleFunc("/confirm_update_tx", a.confirmUpdateTx)
+	mux.HandleFunc("/reject_update_tx", a.rejectUpdateTx)
+	mux.HandleFunc("/counter_update_tx", a.counterUpdateTx)
+	mux.HandleFunc("/close_channel", a.closeChannel)
+	mux.HandleFunc("/propose_close", a.proposeClose)
+	mux.HandleFunc("/accept_close", a.acceptClose)
+	mux.HandleFunc("/check_final_update_tx", a.checkFinalUpdateTx)
+	mux.HandleFunc("/submit_fulfillment", a.submitFulfillment)
+	mux.HandleFunc("/get_fulfillments", a.getFulfillments)
+	mux.HandleFunc("/get_channel", a.getChannel)
+	mux.HandleFunc("/get_channels", a.getChannels)
+	mux.HandleFunc("/get_history", a.getHistory)
+	mux.HandleFunc("/get_evidence", a.getEvidence)
+	mux.HandleFunc("/get_proposed_channels", a.getProposedChannels)
+	mux.HandleFunc("/get_proposed_update_txs", a.getProposedUpdateTxs)
+	mux.HandleFunc("/add_judge", a.addJudge)
+	mux.HandleFunc("/new_account", a.newAccount)
+	mux.HandleFunc("/add_counterparty", a.addCounterparty)
+	mux.HandleFunc("/backup", a.backup)
+	mux.HandleFunc("/unlock", a.unlock)
+	mux.HandleFunc("/lock", a.lock)
+	mux.HandleFunc("/change_passphrase", a.changePassphrase)
 }
 
 func (a *Caller) proposeChannel(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
-		a.fail(w, "no body", 500)
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
 		return
 	}
 
@@ -32,18 +59,22 @@ func (a *Caller) proposeChannel(w http.ResponseWriter, r *http.Request) {
 	}{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		a.fail(w, "body parsing error", 500)
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
 	}
 
 	err = a.Logic.ProposeChannel(req.State, req.AccountPubkey, req.CounterpartyPubkey, req.HoldPeriod)
 	if err != nil {
-		a.fail(w, err.Error(), 500)
+		a.fail(w, err)
+		return
 	}
+
+	a.send(w, "ok")
 }
 
 func (a *Caller) confirmChannel(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
-		a.fail(w, "no body", 500)
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
 		return
 	}
 
@@ -52,40 +83,71 @@ func (a *Caller) confirmChannel(w http.ResponseWriter, r *http.Request) {
 	}{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		a.fail(w, "body parsing error", 500)
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
 	}
 
 	err = a.Logic.ConfirmChannel(req.ChannelId)
 	if err != nil {
-		a.fail(w, err.Error(), 500)
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) declineChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.DeclineChannel(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
 	}
+
+	a.send(w, "ok")
 }
 
 func (a *Caller) sendUpdateTx(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
-		a.fail(w, "no body", 500)
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
 		return
 	}
 
 	req := &struct {
 		State     []byte
 		ChannelId string
-		Fast      bool
 	}{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		a.fail(w, "body parsing error", 500)
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
 	}
 
-	err = a.Logic.SendUpdateTx(req.State, req.ChannelId, req.Fast)
+	err = a.Logic.SendUpdateTx(req.State, req.ChannelId)
 	if err != nil {
-		a.fail(w, err.Error(), 500)
+		a.fail(w, err)
+		return
 	}
+
+	a.send(w, "ok")
 }
 
 func (a *Caller) confirmUpdateTx(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
-		a.fail(w, "no body", 500)
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
 		return
 	}
 
@@ -94,24 +156,502 @@ func (a *Caller) confirmUpdateTx(w http.ResponseWriter, r *http.Request) {
 	}{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		a.fail(w, "body parsing error", 500)
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
 	}
 
 	err = a.Logic.ConfirmUpdateTx(req.ChannelId)
 	if err != nil {
-		a.fail(w, err.Error(), 500)
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) rejectUpdateTx(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+		Reason    string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.RejectUpdateTx(req.ChannelId, req.Reason)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) counterUpdateTx(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		State     []byte
+		ChannelId string
+		Reason    string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.CounterUpdateTx(req.State, req.ChannelId, req.Reason)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) closeChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.CloseChannel(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) proposeClose(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.ProposeClose(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) acceptClose(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.AcceptClose(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) checkFinalUpdateTx(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	// Envelope is the protobuf encoded UpdateTx envelope served by the judge.
+	req := &struct {
+		Envelope []byte
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	ev := &wire.Envelope{}
+	err = proto.Unmarshal(req.Envelope, ev)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "envelope parsing error"))
+		return
+	}
+
+	err = a.Logic.CheckFinalUpdateTx(ev)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) submitFulfillment(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId   string
+		Fulfillment []byte
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.SubmitFulfillment(req.ChannelId, req.Fulfillment)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) getFulfillments(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	fuls, err := a.Logic.GetFulfillments(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
 	}
+
+	a.send(w, views.NewFulfillments(fuls))
+}
+
+func (a *Caller) getChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	ch, err := a.Logic.GetChannel(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewChannel(ch))
+}
+
+func (a *Caller) getHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	ch, err := a.Logic.GetChannel(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	es, err := a.Logic.GetHistory(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewHistory(ch, es))
+}
+
+func (a *Caller) getEvidence(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		ChannelId string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	es, err := a.Logic.GetEvidence(req.ChannelId)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	// The evidence is sent as stored, so that it can be checked with
+	// usc-evidence.
+	a.send(w, es)
+}
+
+func (a *Caller) getChannels(w http.ResponseWriter, r *http.Request) {
+	chs, err := a.Logic.GetChannels()
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewChannels(chs))
+}
+
+func (a *Caller) getProposedChannels(w http.ResponseWriter, r *http.Request) {
+	chs, err := a.Logic.GetProposedChannels()
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewChannels(chs))
+}
+
+func (a *Caller) getProposedUpdateTxs(w http.ResponseWriter, r *http.Request) {
+	chs, err := a.Logic.GetProposedUpdateTxs()
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewChannels(chs))
+}
+
+func (a *Caller) addJudge(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		Name    string
+		Pubkey  []byte
+		Address string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.AddJudge(req.Name, req.Pubkey, req.Address)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) newAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		Name        string
+		JudgePubkey []byte
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	acct, err := a.Logic.NewAccount(req.Name, req.JudgePubkey)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, views.NewAccount(acct))
+}
+
+func (a *Caller) addCounterparty(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		Name        string
+		Pubkey      []byte
+		JudgePubkey []byte
+		Address     string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+
+	err = a.Logic.AddCounterparty(req.Name, req.Pubkey, req.JudgePubkey, req.Address)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+// backup streams a snapshot of the database. Once the snapshot has started, an
+// error can only be signalled by cutting the response short.
+func (a *Caller) backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="main.db"`)
+
+	n, err := a.Logic.Backup(w)
+	if err != nil && n == 0 {
+		w.Header().Del("Content-Disposition")
+		a.fail(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("backup:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (a *Caller) unlock(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		Passphrase string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+	if req.Passphrase == "" {
+		a.fail(w, errs.New(errs.BadRequest, "passphrase is empty"))
+		return
+	}
+
+	err = a.Logic.Unlock([]byte(req.Passphrase))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
+}
+
+func (a *Caller) lock(w http.ResponseWriter, r *http.Request) {
+	a.Logic.Lock()
+	a.send(w, "ok")
+}
+
+func (a *Caller) changePassphrase(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.fail(w, errs.New(errs.BadRequest, "no body"))
+		return
+	}
+
+	req := &struct {
+		OldPassphrase string
+		NewPassphrase string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		a.fail(w, errs.New(errs.BadRequest, "body parsing error"))
+		return
+	}
+	if req.NewPassphrase == "" {
+		a.fail(w, errs.New(errs.BadRequest, "new passphrase is empty"))
+		return
+	}
+
+	err = a.Logic.ChangePassphrase([]byte(req.OldPassphrase), []byte(req.NewPassphrase))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	a.send(w, "ok")
 }
 
-func (a *Caller) fail(w http.ResponseWriter, msg string, status int) {
+func (a *Caller) fail(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/json")
 
+	code := errs.CodeOf(err)
 	data := struct {
 		Error string
-	}{Error: msg}
+		Code  errs.Code
+	}{Error: err.Error(), Code: code}
 
 	resp, _ := json.Marshal(data)
-	w.WriteHeader(status)
+	w.WriteHeader(errs.Status(code))
 	w.Write(resp)
 }
 
@@ -120,8 +660,7 @@ func (a *Caller) send(w http.ResponseWriter, data interface{}) {
 
 	resp, err := json.Marshal(data)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		a.fail(w, "oops something evil has happened", 500)
+		a.fail(w, errs.New(errs.Internal, "oops something evil has happened"))
 		return
 	}
 	w.Write(resp)
@@ -0,0 +1,205 @@
+package servers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/logic"
+)
+
+func TestAddJudge(t *testing.T) {
+	db, err := bolt.Open("/tmp/servers_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/servers_test.db")
+	err = access.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Caller{&logic.Caller{DB: &access.Bolt{DB: db}}}
+	req, err := http.NewRequest("POST", "http://localhost:3004/add_judge", strings.NewReader(`{
+    "name": "sffcu",
+    "pubkey": "R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA=",
+    "address": "http://localhost:3401"
+  }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	app.addJudge(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected status code to be 200, but got: %d", w.Code)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		ref := []byte(`{"Name":"sffcu","Pubkey":"R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA=","Address":"http://localhost:3401"}`)
+
+		fromDB := tx.Bucket([]byte("Judges")).Get([]byte{71, 153, 85, 86, 207, 54, 51, 205, 34, 228, 234, 81, 223, 175, 82, 180, 154, 154, 29, 46, 181, 45, 223, 143, 205, 48, 159, 75, 237, 51, 200, 0})
+
+		if bytes.Compare(fromDB, ref) != 0 {
+			t.Fatal("saved data not correct", string(fromDB), "shib", string(ref))
+		}
+		return nil
+	})
+}
+
+func TestNewAccount(t *testing.T) {
+	db, err := bolt.Open("/tmp/servers_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/servers_test.db")
+	err = access.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Caller{&logic.Caller{DB: &access.Bolt{DB: db}}}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:3004/new_account", strings.NewReader(`{
+    "name": "boogie",
+    "judgePubkey": "R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA="
+  }`))
+	app.newAccount(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("expected unknown judge to fail, but got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost:3004/add_judge", strings.NewReader(`{
+    "name": "sffcu",
+    "pubkey": "R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA=",
+    "address": "http://localhost:3401"
+  }`))
+	app.addJudge(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost:3004/new_account", strings.NewReader(`{
+    "name": "boogie",
+    "judgePubkey": "R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA="
+  }`))
+	app.newAccount(w, req)
+
+	if w.Code != 423 {
+		t.Fatalf("expected locked node to fail, but got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost:3004/unlock", strings.NewReader(`{
+    "passphrase": "hunter2"
+  }`))
+	app.unlock(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected unlock to succeed, but got: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost:3004/new_account", strings.NewReader(`{
+    "name": "boogie",
+    "judgePubkey": "R5lVVs82M80i5OpR369StJqaHS61Ld+PzTCfS+0zyAA="
+  }`))
+	app.newAccount(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected status code to be 200, but got: %d %s", w.Code, w.Body.String())
+	}
+
+	if strings.Contains(w.Body.String(), "Privkey") {
+		t.Fatal("private key returned", w.Body.String())
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		n := tx.Bucket([]byte("Accounts")).Stats().KeyN
+		if n != 1 {
+			t.Fatal("expected one account, got", n)
+		}
+		return nil
+	})
+}
+
+func TestBackup(t *testing.T) {
+	db, err := bolt.Open("/tmp/servers_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/servers_test.db")
+	err = access.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Caller{&logic.Caller{DB: &access.Bolt{DB: db}}}
+	req, err := http.NewRequest("GET", "http://localhost:3004/backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	app.backup(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected status code to be 200, but got: %d", w.Code)
+	}
+
+	err = ioutil.WriteFile("/tmp/servers_backup.db", w.Body.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("/tmp/servers_backup.db")
+
+	backup, err := bolt.Open("/tmp/servers_backup.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	backup.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Channels")) == nil {
+			t.Fatal("backup is missing buckets")
+		}
+		return nil
+	})
+}
+
+func TestMalformedBody(t *testing.T) {
+	app := &Caller{&logic.Caller{DB: access.NewMemory()}}
+
+	for name, h := range map[string]http.HandlerFunc{
+		"propose_channel":   app.proposeChannel,
+		"confirm_channel":   app.confirmChannel,
+		"send_update_tx":    app.sendUpdateTx,
+		"confirm_update_tx": app.confirmUpdateTx,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3004/"+name, strings.NewReader(`{"ChannelId":`))
+		w := httptest.NewRecorder()
+		h(w, req)
+
+		if w.Code != 400 {
+			t.Fatalf("%s: expected status code to be 400, but got: %d", name, w.Code)
+		}
+
+		data := struct{ Code string }{}
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil || data.Code != "BAD_REQUEST" {
+			t.Fatal(name, "expected a single error body, got", w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package servers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/judge"
+	"github.com/jtremback/usc-peer/views"
+)
+
+// call posts a JSON request to the peer's caller API.
+func call(t *testing.T, p *peer, path string, req interface{}) int {
+	code, _ := callBody(t, p, path, req)
+	return code
+}
+
+// callBody posts a JSON request to the peer's caller API and returns the
+// response body as well.
+func callBody(t *testing.T, p *peer, path string, req interface{}) (int, []byte) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	(&Caller{Logic: p.caller}).MountRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(b)))
+	return w.Code, w.Body.Bytes()
+}
+
+func TestCloseChannel(t *testing.T) {
+	db, err := bolt.Open("/tmp/servers_judge_test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("/tmp/servers_judge_test.db")
+	err = judge.MakeBuckets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jd := &judge.Judge{DB: db, AutoConfirm: true}
+	jpub, err := jd.Pubkey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	(&judge.HTTP{Judge: jd}).MountRoutes(mux)
+	jsrv := httptest.NewServer(mux)
+	defer jsrv.Close()
+	jcl := &clients.Judge{}
+
+	me := newPeer(t)
+	them := newPeer(t)
+
+	for _, p := range []*peer{me, them} {
+		err := p.caller.Unlock([]byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.caller.AddJudge("judge", jpub, jsrv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.acct, err = p.caller.NewAccount("acct", jpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = me.caller.AddCounterparty("them", them.acct.Pubkey, jpub, them.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = them.caller.AddCounterparty("me", me.acct.Pubkey, jpub, me.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open a channel, and update it without letting them know that we
+	// confirmed the update.
+
+	err = them.caller.ProposeChannel([]byte("hello"), them.acct.Pubkey, me.acct.Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them.flush()
+
+	chID := me.channel(t).ChannelId
+	err = me.caller.ConfirmChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	me.flush()
+
+	ev, err := jcl.GetOpeningTx(chID, jsrv.URL)
+	if err != nil || ev == nil {
+		t.Fatal("channel not opened by the judge", err)
+	}
+	for _, p := range []*peer{me, them} {
+		err = p.caller.OpenChannel(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = them.caller.SendUpdateTx([]byte("goodbye"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them.flush()
+
+	err = me.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// close_channel
+
+	code := call(t, them, "/submit_fulfillment", map[string]interface{}{"ChannelId": chID, "Fulfillment": []byte("proof")})
+	if code != 412 {
+		t.Fatal("submitted a fulfillment on an open channel", code)
+	}
+
+	code = call(t, them, "/close_channel", map[string]string{"ChannelId": "nope"})
+	if code != 404 {
+		t.Fatal("closed a channel that does not exist", code)
+	}
+
+	code = call(t, them, "/close_channel", map[string]string{"ChannelId": chID})
+	if code != 200 {
+		t.Fatal("close_channel failed", code)
+	}
+	them.flush()
+
+	ch, err := them.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Phase != core.PENDING_CLOSED {
+		t.Fatal("channel not pending closed", ch.Phase)
+	}
+
+	ev, err = jcl.GetUpdateTx(chID, jsrv.URL)
+	if err != nil || ev == nil {
+		t.Fatal("no update tx posted", err)
+	}
+	utx := &wire.UpdateTx{}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utx.SequenceNumber != 0 || string(utx.State) != "hello" {
+		t.Fatal("channel not closed with the opening state", utx)
+	}
+
+	// check_final_update_tx
+
+	code = call(t, me, "/check_final_update_tx", map[string][]byte{"Envelope": []byte("garbage")})
+	if code != 400 {
+		t.Fatal("garbage envelope was not refused", code)
+	}
+
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = call(t, me, "/check_final_update_tx", map[string][]byte{"Envelope": b})
+	if code != 200 {
+		t.Fatal("check_final_update_tx failed", code)
+	}
+	me.flush()
+
+	ch, err = me.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Phase != core.PENDING_CLOSED {
+		t.Fatal("channel not pending closed", ch.Phase)
+	}
+
+	ev, err = jcl.GetUpdateTx(chID, jsrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proto.Unmarshal(ev.Payload, utx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utx.SequenceNumber != 1 || string(utx.State) != "goodbye" {
+		t.Fatal("later update tx not posted", utx)
+	}
+
+	// submit_fulfillment and get_fulfillments
+
+	code = call(t, them, "/submit_fulfillment", map[string]interface{}{"ChannelId": chID, "Fulfillment": []byte("proof")})
+	if code != 200 {
+		t.Fatal("submit_fulfillment failed", code)
+	}
+	them.flush()
+
+	code, b = callBody(t, them, "/get_fulfillments", map[string]string{"ChannelId": chID})
+	if code != 200 {
+		t.Fatal("get_fulfillments failed", code)
+	}
+	fuls := []*views.Fulfillment{}
+	err = json.Unmarshal(b, &fuls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fuls) != 1 || string(fuls[0].Fulfillment) != "proof" || !fuls[0].Accepted {
+		t.Fatal("fulfillment not accepted by the judge", fuls)
+	}
+
+	code = call(t, them, "/get_fulfillments", map[string]string{"ChannelId": "nope"})
+	if code != 404 {
+		t.Fatal("got fulfillments of a channel that does not exist", code)
+	}
+}
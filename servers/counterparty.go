@@ -7,6 +7,7 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/errs"
 	"github.com/jtremback/usc-peer/logic"
 )
 
@@ -14,61 +15,139 @@ type CounterpartyHTTP struct {
 	Logic *logic.Counterparty
 }
 
+// maxBodySize is the most we read of a request. Anyone can reach this
+// listener, and no envelope comes anywhere close.
+const maxBodySize = 1 << 20
+
 func (a *CounterpartyHTTP) MountRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/add_channel", a.addChannel)
+	mux.HandleFunc("/reject_channel", a.rejectChannel)
+	mux.HandleFunc("/add_update_tx", a.addUpdateTx)
+	mux.HandleFunc("/add_full_update_tx", a.addFullUpdateTx)
+	mux.HandleFunc("/reject_update_tx", a.rejectUpdateTx)
+	mux.HandleFunc("/propose_close", a.proposeClose)
 }
 
 func (a *CounterpartyHTTP) addChannel(w http.ResponseWriter, r *http.Request) {
-	if r.Body == nil {
-		a.fail(w, "no body", 500)
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
+	err = a.Logic.AddChannel(ev)
 	if err != nil {
-		a.fail(w, "server error", 500)
+		a.fail(w, err)
+		return
 	}
+	a.send(w, "ok")
+}
 
-	ev := &wire.Envelope{}
-	proto.Unmarshal(b, ev)
+func (a *CounterpartyHTTP) rejectChannel(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
 
-	err = a.Logic.AddChannel(ev)
+	err = a.Logic.RejectChannel(ev)
 	if err != nil {
-		a.fail(w, "server error", 500)
+		a.fail(w, err)
+		return
 	}
 	a.send(w, "ok")
 }
 
 func (a *CounterpartyHTTP) addUpdateTx(w http.ResponseWriter, r *http.Request) {
-	if r.Body == nil {
-		a.fail(w, "no body", 500)
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
+	err = a.Logic.AddUpdateTx(ev)
 	if err != nil {
-		a.fail(w, "server error", 500)
+		a.fail(w, err)
+		return
 	}
+	a.send(w, "ok")
+}
 
-	ev := &wire.Envelope{}
-	proto.Unmarshal(b, ev)
+func (a *CounterpartyHTTP) addFullUpdateTx(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
 
-	err = a.Logic.AddUpdateTx(ev)
+	err = a.Logic.AddFullUpdateTx(ev)
 	if err != nil {
-		a.fail(w, "server error", 500)
+		a.fail(w, err)
+		return
 	}
 	a.send(w, "ok")
 }
 
-func (a *CounterpartyHTTP) fail(w http.ResponseWriter, msg string, status int) {
+func (a *CounterpartyHTTP) rejectUpdateTx(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	err = a.Logic.RejectUpdateTx(ev, r.URL.Query().Get("reason"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *CounterpartyHTTP) proposeClose(w http.ResponseWriter, r *http.Request) {
+	ev, err := a.readEnvelope(w, r)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+
+	err = a.Logic.ProposeClose(ev)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.send(w, "ok")
+}
+
+func (a *CounterpartyHTTP) readEnvelope(w http.ResponseWriter, r *http.Request) (*wire.Envelope, error) {
+	if r.Body == nil {
+		return nil, errs.New(errs.BadRequest, "no body")
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, errs.New(errs.BadRequest, "body too large or unreadable")
+	}
+
+	ev := &wire.Envelope{}
+	err = proto.Unmarshal(b, ev)
+	if err != nil {
+		return nil, errs.New(errs.BadRequest, "body parsing error")
+	}
+
+	return ev, nil
+}
+
+func (a *CounterpartyHTTP) fail(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/json")
 
+	code := errs.CodeOf(err)
 	data := struct {
 		Error string
-	}{Error: msg}
+		Code  errs.Code
+	}{Error: err.Error(), Code: code}
 
 	resp, _ := json.Marshal(data)
-	w.WriteHeader(status)
+	w.WriteHeader(errs.Status(code))
 	w.Write(resp)
 }
 
@@ -77,8 +156,7 @@ func (a *CounterpartyHTTP) send(w http.ResponseWriter, data interface{}) {
 
 	resp, err := json.Marshal(data)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		a.fail(w, "oops something evil has happened", 500)
+		a.fail(w, errs.New(errs.Internal, "oops something evil has happened"))
 		return
 	}
 	w.Write(resp)
@@ -0,0 +1,196 @@
+package servers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/logic"
+)
+
+type peer struct {
+	caller *logic.Caller
+	outbox *logic.Outbox
+	srv    *httptest.Server
+	acct   *core.Account
+}
+
+// newPeer starts a node with its counterparty API on a test server.
+func newPeer(t *testing.T) *peer {
+	db := access.NewMemory()
+
+	mux := http.NewServeMux()
+	(&CounterpartyHTTP{Logic: &logic.Counterparty{DB: db}}).MountRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	caller := &logic.Caller{DB: db, CounterpartyCl: &clients.Counterparty{}, JudgeCl: &clients.Judge{}}
+	return &peer{caller: caller, outbox: &logic.Outbox{Caller: caller}, srv: srv}
+}
+
+// flush makes one delivery pass over the outbox.
+func (a *peer) flush() {
+	a.outbox.Start()
+	a.outbox.Stop()
+}
+
+func (a *peer) channel(t *testing.T) *core.Channel {
+	chs, err := a.caller.GetChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range chs {
+		if ch.Phase == core.PENDING_OPEN {
+			return ch
+		}
+	}
+	t.Fatal("no pending channel")
+	return nil
+}
+
+func post(t *testing.T, url string, ev *wire.Envelope) int {
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCounterpartyHTTP(t *testing.T) {
+	jpub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	me := newPeer(t)
+	them := newPeer(t)
+
+	for _, p := range []*peer{me, them} {
+		err := p.caller.Unlock([]byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.caller.AddJudge("judge", jpub, "http://127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.acct, err = p.caller.NewAccount("acct", jpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := me.caller.AddCounterparty("them", them.acct.Pubkey, jpub, them.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = them.caller.AddCounterparty("me", me.acct.Pubkey, jpub, me.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add_channel
+
+	otx, err := proto.Marshal(&wire.OpeningTx{ChannelId: "short", Pubkeys: [][]byte{them.acct.Pubkey[:31], me.acct.Pubkey, jpub}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := post(t, me.srv.URL+"/add_channel", &wire.Envelope{Payload: otx})
+	if code != 400 {
+		t.Fatal("opening tx with a short pubkey was not refused", code)
+	}
+
+	// reject_channel
+
+	err = them.caller.ProposeChannel([]byte("hello"), them.acct.Pubkey, me.acct.Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them.flush()
+
+	ch := me.channel(t)
+
+	code = post(t, them.srv.URL+"/reject_channel", ch.OpeningTxEnvelope)
+	if code != 403 {
+		t.Fatal("unsigned rejection was not refused", code)
+	}
+
+	err = me.caller.DeclineChannel(ch.ChannelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	me.flush()
+
+	ch, err = them.caller.GetChannel(ch.ChannelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.PhaseName(ch) != "ABANDONED" {
+		t.Fatal("channel not abandoned", access.PhaseName(ch))
+	}
+
+	// add_update_tx
+
+	err = them.caller.ProposeChannel([]byte("hello again"), them.acct.Pubkey, me.acct.Pubkey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them.flush()
+
+	chID := me.channel(t).ChannelId
+
+	code = post(t, me.srv.URL+"/add_update_tx", &wire.Envelope{Payload: []byte("garbage")})
+	if code != 400 {
+		t.Fatal("garbage update tx was not refused", code)
+	}
+
+	code = post(t, me.srv.URL+"/add_update_tx", &wire.Envelope{Payload: make([]byte, 2<<20)})
+	if code != 400 {
+		t.Fatal("oversized body was not refused", code)
+	}
+
+	err = them.caller.SendUpdateTx([]byte("goodbye"), chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them.flush()
+
+	ch, err = me.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ProposedUpdateTx == nil || string(ch.ProposedUpdateTx.State) != "goodbye" {
+		t.Fatal("update tx not received", ch.ProposedUpdateTx)
+	}
+
+	// add_full_update_tx
+
+	code = post(t, them.srv.URL+"/add_full_update_tx", ch.ProposedUpdateTxEnvelope)
+	if code != 403 {
+		t.Fatal("update tx with one signature was accepted as full", code)
+	}
+
+	err = me.caller.ConfirmUpdateTx(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	me.flush()
+
+	ch, err = them.caller.GetChannel(chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LastFullUpdateTx == nil || string(ch.LastFullUpdateTx.State) != "goodbye" {
+		t.Fatal("full update tx not received", ch.LastFullUpdateTx)
+	}
+}
@@ -0,0 +1,267 @@
+// Package views turns channels and the envelopes in them into JSON that can be
+// read without knowing the wire format. Envelope payloads are decoded and
+// shown using the protobuf JSON mapping.
+package views
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+	"github.com/jtremback/usc-peer/logic"
+)
+
+// Channel is what the caller API shows of a channel. It leaves out the
+// account's private key.
+type Channel struct {
+	ChannelId  string
+	Phase      string
+	Me         uint32
+	HoldPeriod uint32
+
+	OpeningTx        *Envelope
+	ProposedUpdateTx *Envelope
+	LastFullUpdateTx *Envelope
+
+	Account      *Account
+	Counterparty *Counterparty
+	Judge        *core.Judge
+}
+
+// Envelope is a decoded OpeningTx or UpdateTx envelope.
+type Envelope struct {
+	// Tx is the payload in the protobuf JSON mapping.
+	Tx json.RawMessage
+
+	// SequenceNumber and Fast are only set for an UpdateTx.
+	SequenceNumber uint32
+	Fast           bool
+
+	Signatures []*Signature
+	// FullySigned is true if every signer's signature is present and valid.
+	FullySigned bool
+}
+
+// Signature shows whether one signer has signed an envelope.
+type Signature struct {
+	// Role is "me", "counterparty" or "judge".
+	Role    string
+	Pubkey  []byte
+	Present bool
+	Valid   bool
+}
+
+type Account struct {
+	Name   string
+	Pubkey []byte
+	Judge  *core.Judge
+}
+
+type Counterparty struct {
+	Name    string
+	Pubkey  []byte
+	Address string
+}
+
+// HistoryEntry is an entry in a channel's history, with its envelope decoded.
+type HistoryEntry struct {
+	Id        uint64
+	Kind      string
+	Direction string
+	Event     string
+	Peer      string
+	Time      time.Time
+	Reason    string
+	Envelope  *Envelope
+}
+
+type Fulfillment struct {
+	Fulfillment []byte
+	Signatures  [][]byte
+	Accepted    bool
+}
+
+func NewChannel(ch *core.Channel) *Channel {
+	v := &Channel{
+		ChannelId: ch.ChannelId,
+		Phase:     PhaseName(ch),
+		Me:        ch.Me,
+		Judge:     ch.Judge,
+	}
+
+	if ch.OpeningTx != nil {
+		v.HoldPeriod = ch.OpeningTx.HoldPeriod
+	}
+	if ch.Account != nil {
+		v.Account = NewAccount(ch.Account)
+	}
+	if ch.Counterparty != nil {
+		v.Counterparty = &Counterparty{
+			Name:    ch.Counterparty.Name,
+			Pubkey:  ch.Counterparty.Pubkey,
+			Address: ch.Counterparty.Address,
+		}
+	}
+
+	// The OpeningTx is signed by both participants and the judge, an UpdateTx
+	// by the participants only.
+	signers := roles(ch)
+	if ch.OpeningTxEnvelope != nil {
+		v.OpeningTx = newEnvelope(ch.OpeningTxEnvelope, ch.OpeningTxEnvelope.Payload, &wire.OpeningTx{}, signers)
+	}
+	if ch.ProposedUpdateTxEnvelope != nil {
+		v.ProposedUpdateTx = newEnvelope(ch.ProposedUpdateTxEnvelope, ch.ProposedUpdateTxEnvelope.Payload, &wire.UpdateTx{}, signers[:2])
+	}
+	if ch.LastFullUpdateTxEnvelope != nil {
+		v.LastFullUpdateTx = newEnvelope(ch.LastFullUpdateTxEnvelope, ch.LastFullUpdateTxEnvelope.Payload, &wire.UpdateTx{}, signers[:2])
+	}
+
+	return v
+}
+
+func NewChannels(chs []*core.Channel) []*Channel {
+	vs := []*Channel{}
+	for _, ch := range chs {
+		vs = append(vs, NewChannel(ch))
+	}
+	return vs
+}
+
+func NewAccount(acct *core.Account) *Account {
+	return &Account{
+		Name:   acct.Name,
+		Pubkey: acct.Pubkey,
+		Judge:  acct.Judge,
+	}
+}
+
+func NewFulfillments(fuls []*logic.Fulfillment) []*Fulfillment {
+	vs := []*Fulfillment{}
+	for _, ful := range fuls {
+		vs = append(vs, &Fulfillment{
+			Fulfillment: ful.Envelope.Payload,
+			Signatures:  ful.Envelope.Signatures,
+			Accepted:    ful.Accepted,
+		})
+	}
+	return vs
+}
+
+// NewHistory decodes the history of a channel. Signatures are checked against
+// the channel's signers.
+func NewHistory(ch *core.Channel, es []*access.HistoryEntry) []*HistoryEntry {
+	signers := roles(ch)
+	vs := []*HistoryEntry{}
+	for _, e := range es {
+		v := &HistoryEntry{
+			Id:        e.Id,
+			Kind:      e.Kind,
+			Direction: e.Direction,
+			Event:     e.Event,
+			Peer:      e.Peer,
+			Time:      e.Time,
+			Reason:    e.Reason,
+		}
+		if e.Envelope != nil {
+			msg := signedMessage(ch, e)
+			switch e.Kind {
+			case "OpeningTx":
+				v.Envelope = newEnvelope(e.Envelope, msg, &wire.OpeningTx{}, signers)
+			case "UpdateTx":
+				v.Envelope = newEnvelope(e.Envelope, msg, &wire.UpdateTx{}, signers[:2])
+			default:
+				v.Envelope = newEnvelope(e.Envelope, msg, nil, signers[:2])
+			}
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func PhaseName(ch *core.Channel) string {
+	return access.PhaseName(ch)
+}
+
+// roles returns the signers of a channel's envelopes in signature order.
+func roles(ch *core.Channel) []*Signature {
+	me := &Signature{Role: "me"}
+	them := &Signature{Role: "counterparty"}
+	jd := &Signature{Role: "judge"}
+
+	if ch.Account != nil {
+		me.Pubkey = ch.Account.Pubkey
+	}
+	if ch.Counterparty != nil {
+		them.Pubkey = ch.Counterparty.Pubkey
+	}
+	if ch.Judge != nil {
+		jd.Pubkey = ch.Judge.Pubkey
+	}
+
+	if ch.Me == 0 {
+		return []*Signature{me, them, jd}
+	}
+	return []*Signature{them, me, jd}
+}
+
+// signedMessage returns what the signatures on a history entry's envelope are
+// over. That is the payload, except for the rejection notices we received and
+// for fulfillments, which are signed over a message of their own.
+func signedMessage(ch *core.Channel, e *access.HistoryEntry) []byte {
+	switch {
+	case e.Direction == "Received" && e.Event == "Rejected":
+		return clients.RejectionMessage(e.Envelope.Payload, e.Reason)
+	case e.Kind == "Fulfillment":
+		return clients.FulfillmentMessage(ch.ChannelId, e.Envelope.Payload)
+	}
+	return e.Envelope.Payload
+}
+
+// newEnvelope decodes an envelope, checking each signer's signature over msg.
+func newEnvelope(ev *wire.Envelope, msg []byte, tx proto.Message, signers []*Signature) *Envelope {
+	v := &Envelope{
+		FullySigned: true,
+	}
+
+	if tx == nil {
+		// Not a protobuf payload, show it as it is.
+		v.Tx, _ = json.Marshal(ev.Payload)
+	} else if err := proto.Unmarshal(ev.Payload, tx); err == nil {
+		m := &jsonpb.Marshaler{OrigName: true}
+		buf := &bytes.Buffer{}
+		err = m.Marshal(buf, tx)
+		if err == nil {
+			v.Tx = buf.Bytes()
+		}
+	}
+
+	if utx, ok := tx.(*wire.UpdateTx); ok {
+		v.SequenceNumber = utx.SequenceNumber
+		v.Fast = utx.Fast
+	}
+
+	for i, signer := range signers {
+		sig := &Signature{
+			Role:   signer.Role,
+			Pubkey: signer.Pubkey,
+		}
+		if i < len(ev.Signatures) && len(ev.Signatures[i]) > 0 {
+			sig.Present = true
+			sig.Valid = len(sig.Pubkey) == ed25519.PublicKeySize &&
+				ed25519.Verify(ed25519.PublicKey(sig.Pubkey), msg, ev.Signatures[i])
+		}
+		if !sig.Valid {
+			v.FullySigned = false
+		}
+		v.Signatures = append(v.Signatures, sig)
+	}
+
+	return v
+}
@@ -0,0 +1,153 @@
+package views
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	core "github.com/jtremback/usc-core/peer"
+	"github.com/jtremback/usc-core/wire"
+	"github.com/jtremback/usc-peer/access"
+	"github.com/jtremback/usc-peer/clients"
+)
+
+func TestNewChannel(t *testing.T) {
+	mpub, mpriv, _ := ed25519.GenerateKey(rand.Reader)
+	tpub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	utx := &wire.UpdateTx{
+		ChannelId:      "xyz23",
+		SequenceNumber: 4,
+		State:          []byte("state"),
+		Fast:           true,
+	}
+	b, err := proto.Marshal(utx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := &core.Channel{
+		ChannelId: "xyz23",
+		Phase:     core.OPEN,
+		Me:        1,
+
+		OpeningTx: &wire.OpeningTx{HoldPeriod: 20},
+
+		ProposedUpdateTx: utx,
+		ProposedUpdateTxEnvelope: &wire.Envelope{
+			Payload:    b,
+			Signatures: [][]byte{[]byte{}, ed25519.Sign(mpriv, b)},
+		},
+
+		Account: &core.Account{
+			Name:    "crow",
+			Pubkey:  mpub,
+			Privkey: mpriv,
+		},
+		Counterparty: &core.Counterparty{
+			Name:   "flerb",
+			Pubkey: tpub,
+		},
+	}
+
+	v := NewChannel(ch)
+
+	if v.Phase != "OPEN" || v.HoldPeriod != 20 {
+		t.Fatal("channel incorrect", v.Phase, v.HoldPeriod)
+	}
+
+	ev := v.ProposedUpdateTx
+	if ev.SequenceNumber != 4 || !ev.Fast {
+		t.Fatal("update tx incorrect", ev.SequenceNumber, ev.Fast)
+	}
+
+	tx := map[string]interface{}{}
+	err = json.Unmarshal(ev.Tx, &tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx["channel_id"] != "xyz23" {
+		t.Fatal("update tx not decoded", string(ev.Tx))
+	}
+
+	if len(ev.Signatures) != 2 || ev.FullySigned {
+		t.Fatal("signatures incorrect", ev.Signatures)
+	}
+	if ev.Signatures[0].Role != "counterparty" || ev.Signatures[0].Present {
+		t.Fatal("counterparty signature incorrect", ev.Signatures[0])
+	}
+	if ev.Signatures[1].Role != "me" || !ev.Signatures[1].Valid {
+		t.Fatal("my signature incorrect", ev.Signatures[1])
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "Privkey") {
+		t.Fatal("private key shown", string(js))
+	}
+}
+
+func TestNewHistory(t *testing.T) {
+	mpub, mpriv, _ := ed25519.GenerateKey(rand.Reader)
+	tpub, tpriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	b, err := proto.Marshal(&wire.UpdateTx{ChannelId: "xyz23", SequenceNumber: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := &core.Channel{
+		ChannelId:    "xyz23",
+		Me:           0,
+		Account:      &core.Account{Pubkey: mpub},
+		Counterparty: &core.Counterparty{Pubkey: tpub},
+	}
+
+	es := []*access.HistoryEntry{
+		{
+			Kind:      "UpdateTx",
+			Direction: "Sent",
+			Event:     "Proposed",
+			Envelope:  &wire.Envelope{Payload: b, Signatures: [][]byte{ed25519.Sign(mpriv, b)}},
+		},
+		{
+			Kind:      "UpdateTx",
+			Direction: "Received",
+			Event:     "Rejected",
+			Reason:    "no thanks",
+			Envelope:  &wire.Envelope{Payload: b, Signatures: [][]byte{{}, ed25519.Sign(tpriv, clients.RejectionMessage(b, "no thanks"))}},
+		},
+		{
+			Kind:      "Fulfillment",
+			Direction: "Sent",
+			Event:     "Signed",
+			Envelope:  &wire.Envelope{Payload: []byte("proof"), Signatures: [][]byte{ed25519.Sign(mpriv, clients.FulfillmentMessage("xyz23", []byte("proof")))}},
+		},
+	}
+
+	vs := NewHistory(ch, es)
+	if len(vs) != 3 {
+		t.Fatal("expected three entries, got", len(vs))
+	}
+	if !vs[0].Envelope.Signatures[0].Valid {
+		t.Fatal("proposal signature not valid", vs[0].Envelope.Signatures[0])
+	}
+	if !vs[1].Envelope.Signatures[1].Valid {
+		t.Fatal("rejection notice signature not valid", vs[1].Envelope.Signatures[1])
+	}
+	if !vs[2].Envelope.Signatures[0].Valid {
+		t.Fatal("fulfillment signature not valid", vs[2].Envelope.Signatures[0])
+	}
+
+	// A notice with a changed reason does not check out.
+	es[1].Reason = "made up"
+	vs = NewHistory(ch, es)
+	if vs[1].Envelope.Signatures[1].Valid {
+		t.Fatal("rejection notice valid with a changed reason")
+	}
+}